@@ -17,19 +17,34 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/asama-ai/cgroupv2_exporter/collector"
+	"github.com/asama-ai/cgroupv2_exporter/remotewrite"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
 	"github.com/prometheus/common/version"
@@ -43,9 +58,19 @@ import (
 type handler struct {
 	unfilteredHandler http.Handler
 	scrapeSem         chan struct{}
+	scrapeWait        time.Duration // how long a scrape waits for a slot of scrapeSem
+	inFlight          atomic.Int64  // scrapes being served
+	rejected          atomic.Uint64 // scrapes rejected for exceeding --web.max-requests
 	includeExporter   bool
 	logger            *slog.Logger
 	cgroups           []string
+	available         map[string]bool
+	collectors        []string        // names of the collectors enabled via command-line flags
+	writeMetrics      func(io.Writer) // writes the metrics of the unfiltered handler
+	procfs            string          // procfs mount point, to resolve ?pid=
+	cgroupfs          string          // cgroup2 mount point, to resolve ?pid=
+	runtimeInfo       string          // id of the cgroupv2_exporter_runtime_info metric, empty if disabled
+	noStore           bool            // mark responses as not to be cached by proxies
 }
 
 func newHandler(cgroups []string, includeExporterMetrics bool, maxRequests int, logger *slog.Logger) *handler {
@@ -53,11 +78,18 @@ func newHandler(cgroups []string, includeExporterMetrics bool, maxRequests int,
 		includeExporter: includeExporterMetrics,
 		logger:          logger,
 		cgroups:         cgroups,
+		procfs:          "/proc",
+		cgroupfs:        "/sys/fs/cgroup",
+		noStore:         true,
+	}
+	if len(cgroups) > 0 {
+		h.available = collector.CheckAvailability(cgroups[0], logger)
 	}
 	if maxRequests > 0 {
 		h.scrapeSem = make(chan struct{}, maxRequests)
+		h.scrapeWait = maxRequestsWait
 	}
-	if innerHandler, err := h.innerHandler(cgroups); err != nil {
+	if innerHandler, err := h.innerHandler(cgroups, true, includeExporterMetrics); err != nil {
 		panic(fmt.Sprintf("Couldn't create metrics handler: %s", err))
 	} else {
 		h.unfilteredHandler = innerHandler
@@ -67,16 +99,63 @@ func newHandler(cgroups []string, includeExporterMetrics bool, maxRequests int,
 
 // ServeHTTP implements http.Handler.
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.noStore {
+		// A proxy serving a cached response would make the metrics look stale.
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+	}
 	filters := r.URL.Query()["collect[]"]
 	h.logger.Debug("collect query", slog.Any("filters", filters))
+	requested := r.URL.Query()["cgroup"]
+	h.logger.Debug("cgroup query", slog.Any("cgroups", requested))
+	pid := r.URL.Query().Get("pid")
+
+	includeExporter := h.includeExporter
+	if v := r.URL.Query().Get("exporter-metrics"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid exporter-metrics parameter: %q", v)))
+			return
+		}
+		includeExporter = b
+	}
 
-	if len(filters) == 0 {
+	if len(filters) == 0 && len(requested) == 0 && pid == "" && includeExporter == h.includeExporter {
 		h.unfilteredHandler.ServeHTTP(w, r)
 		return
 	}
-	filteredHandler, err := h.innerHandler(h.cgroups, filters...)
+
+	var (
+		filteredHandler http.Handler
+		err             error
+	)
+	if len(requested) > 0 || pid != "" {
+		var cgroups []string
+		if pid != "" {
+			cgroups, err = h.pidCgroups(pid)
+		} else {
+			cgroups, err = h.selectCgroups(requested)
+		}
+		if err == nil {
+			filteredHandler, err = h.innerHandler(cgroups, false, includeExporter, filters...)
+		}
+	} else {
+		filteredHandler, err = h.innerHandler(h.cgroups, true, includeExporter, filters...)
+	}
 	if err != nil {
 		h.logger.Warn("Couldn't create filtered metrics handler", "err", err)
+		var filterErr *collector.FilterError
+		if errors.As(err, &filterErr) {
+			// A disabled collector is a conflict with the configuration, not a bad name.
+			status := http.StatusBadRequest
+			if filterErr.Disabled {
+				status = http.StatusConflict
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "Couldn't create filtered metrics handler: %s\nEnabled collectors: %s\n", err, strings.Join(filterErr.Enabled, ", "))
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("Couldn't create filtered metrics handler: %s", err)))
 		return
@@ -84,18 +163,67 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	filteredHandler.ServeHTTP(w, r)
 }
 
+// selectCgroups resolves the cgroup paths requested via ?cgroup= against the
+// cgroups discovered from the configured globs. Only those may be scraped, so a
+// request can never make the exporter read files outside of them.
+func (h *handler) selectCgroups(requested []string) ([]string, error) {
+	known := make(map[string]bool, len(h.cgroups))
+	for _, cgroup := range h.cgroups {
+		known[filepath.Clean(cgroup)] = true
+	}
+	cgroups := make([]string, 0, len(requested))
+	for _, path := range requested {
+		path = filepath.Clean(path)
+		if !known[path] {
+			return nil, fmt.Errorf("cgroup %q is not matched by the configured globs", path)
+		}
+		cgroups = append(cgroups, path)
+	}
+	return cgroups, nil
+}
+
+// maxRequestsWait bounds how long a scrape over --web.max-requests is queued
+// before it is rejected, so that a slow scrape can't pile up requests.
+const maxRequestsWait = 10 * time.Second
+
+const (
+	// pidMaxDepth and pidMaxCgroups bound the subtree scraped for ?pid=.
+	pidMaxDepth   = 8
+	pidMaxCgroups = 1000
+)
+
+// pidCgroups resolves ?pid= to the cgroup subtree of that process, for
+// debugging a single workload. Like ?cgroup=, it is restricted to the cgroups
+// discovered from the configured globs.
+func (h *handler) pidCgroups(pid string) ([]string, error) {
+	n, err := strconv.Atoi(pid)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid pid %q", pid)
+	}
+	cgroup, err := collector.CgroupOfPID(h.procfs, h.cgroupfs, n)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resolve cgroup of pid %d: %w", n, err)
+	}
+	return collector.CgroupSubtree(cgroup, h.cgroups, pidMaxDepth, pidMaxCgroups)
+}
+
 // innerHandler is used to create both the one unfiltered http.Handler to be
 // wrapped by the outer handler and also the filtered handlers created on the
-// fly. The former is accomplished by calling innerHandler without any arguments
-// (in which case it will log all the collectors enabled via command-line
-// flags).
-func (h *handler) innerHandler(cgroups []string, filters ...string) (http.Handler, error) {
-	cgc, err := collector.NewCgroupv2Collector(cgroups, h.logger, filters...)
+// fly. The former is created first, before any filtered handler, and logs all
+// the collectors enabled via command-line flags. Handlers for a subset of the
+// cgroups must not use the cached collectors, which are bound to the full
+// cgroup set. includeExporter selects whether the process metrics are appended.
+func (h *handler) innerHandler(cgroups []string, cached, includeExporter bool, filters ...string) (http.Handler, error) {
+	newCollector := collector.NewCgroupv2Collector
+	if !cached {
+		newCollector = collector.NewCgroupv2SubsetCollector
+	}
+	cgc, err := newCollector(cgroups, h.logger, filters...)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't create collector: %s", err)
+		return nil, fmt.Errorf("couldn't create collector: %w", err)
 	}
 
-	if len(filters) == 0 {
+	if h.unfilteredHandler == nil {
 		h.logger.Info("enabled collectors")
 		names := make([]string, 0, len(cgc.Collectors))
 		for n := range cgc.Collectors {
@@ -105,34 +233,201 @@ func (h *handler) innerHandler(cgroups []string, filters ...string) (http.Handle
 		for _, name := range names {
 			h.logger.Info("collector enabled", "name", name)
 		}
+		h.collectors = names
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if h.scrapeSem != nil {
-			h.scrapeSem <- struct{}{}
-			defer func() { <-h.scrapeSem }()
-		}
-
+	write := func(w io.Writer) {
 		ms := metrics.NewSet()
+		ms.GetOrCreateGauge(collector.ScrapesInFlightMetric, nil).Set(float64(h.inFlight.Load()))
+		ms.GetOrCreateFloatCounter(collector.ScrapesRejectedMetric).Set(float64(h.rejected.Load()))
 		ms.GetOrCreateGauge(collector.BuildInfoMetric(
 			version.Version, version.Revision, version.Branch, version.GoVersion,
 		), nil).Set(1)
+		if h.runtimeInfo != "" {
+			ms.GetOrCreateGauge(h.runtimeInfo, nil).Set(1)
+		}
+		mounted := 0.0
+		if collector.CgroupfsMounted(h.cgroupfs) {
+			mounted = 1
+		}
+		ms.GetOrCreateGauge(collector.CgroupfsMountedMetric, nil).Set(mounted)
+		if err := collector.WriteFDMetrics(ms); err != nil {
+			h.logger.Debug("couldn't read file descriptor usage", "err", err)
+		}
+		for name, ok := range h.available {
+			v := 0.0
+			if ok {
+				v = 1
+			}
+			ms.GetOrCreateGauge(collector.AvailableMetric(name), nil).Set(v)
+		}
 
 		cgc.Scrape(ms)
 
 		ms.WritePrometheus(w)
-		if h.includeExporter {
+		if includeExporter {
 			metrics.WriteProcessMetrics(w)
 		}
+	}
+	if h.unfilteredHandler == nil {
+		h.writeMetrics = write
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.scrapeSem != nil {
+			timer := time.NewTimer(h.scrapeWait)
+			defer timer.Stop()
+			select {
+			case h.scrapeSem <- struct{}{}:
+				defer func() { <-h.scrapeSem }()
+			case <-timer.C:
+				h.rejected.Add(1)
+				http.Error(w, "Too many concurrent scrapes", http.StatusServiceUnavailable)
+				return
+			case <-r.Context().Done():
+				// The client gave up, e.g. at its scrape timeout; nothing was rejected.
+				return
+			}
+		}
+		h.inFlight.Add(1)
+		defer h.inFlight.Add(-1)
+
+		write(w)
 	}), nil
 }
 
+// startPush pushes the unfiltered metrics to the Pushgateway at gatewayURL every
+// interval until ctx is done, grouped by job cgroupv2_exporter and instance. A
+// PUT replaces the whole group, so metrics of vanished cgroups disappear.
+func (h *handler) startPush(ctx context.Context, gatewayURL, instance string, interval time.Duration) error {
+	if instance == "" {
+		return errors.New("empty push instance, set --push.instance")
+	}
+	pushURL := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/cgroupv2_exporter/" + groupingKey("instance", instance)
+	return metrics.InitPushExtWithOptions(ctx, pushURL, interval, h.writeMetrics, &metrics.PushOptions{
+		Method: http.MethodPut,
+		// Push uncompressed, which any Pushgateway accepts.
+		DisableCompression: true,
+	})
+}
+
+// groupingKey returns the Pushgateway URL path of a grouping label. The
+// Pushgateway splits the path at every /, even an escaped one, so such values
+// are sent base64 encoded.
+func groupingKey(name, value string) string {
+	if strings.Contains(value, "/") {
+		return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// serveReady answers /-/ready. Cgroups are only discovered at startup, so
+// without any, e.g. as no cgroup filesystem was mounted yet, every scrape stays
+// empty until a restart, which must not pass for a healthy exporter.
+func (h *handler) serveReady(w http.ResponseWriter, r *http.Request) {
+	if len(h.cgroups) == 0 {
+		http.Error(w, fmt.Sprintf("No cgroups discovered under %s", h.cgroupfs), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// newLandingPage creates the landing page, which besides linking to the metrics
+// lists the enabled collectors and the number of discovered cgroups so that the
+// configuration can be sanity-checked in a browser.
+func newLandingPage(metricsPath string, h *handler) (http.Handler, error) {
+	var extra strings.Builder
+	fmt.Fprintf(&extra, "<h2>Configuration</h2>\n<p>Discovered cgroups: %d</p>\n", len(h.cgroups))
+	extra.WriteString("<p>Enabled collectors:</p>\n<ul>\n")
+	for _, name := range h.collectors {
+		fmt.Fprintf(&extra, "<li>%s</li>\n", html.EscapeString(name))
+	}
+	extra.WriteString("</ul>\n")
+
+	return web.NewLandingPage(web.LandingConfig{
+		Name:        "CgroupV2 Exporter",
+		Description: "Prometheus CgroupV2 Exporter",
+		Version:     version.Info(),
+		Links: []web.LandingLinks{
+			{
+				Address: metricsPath,
+				Text:    "Metrics",
+			},
+		},
+		ExtraHTML: extra.String(),
+	})
+}
+
+// listenUnix listens on a Unix domain socket at path, replacing a stale socket
+// file left behind by a previous run, and applies the given file permissions.
+// The socket file is removed again when the returned listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("couldn't remove stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("couldn't set socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+// validateListenAddress checks that addr is a well-formed host:port pair.
+// IPv6 literals must be bracketed, e.g. [::1]:9100.
+func validateListenAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid port %q: %w", port, err)
+	}
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return fmt.Errorf("invalid IPv6 address %q: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// validateListenAddresses validates every address, logging each invalid one,
+// so that all typos show up at once instead of as a late bind error.
+// vsock:// addresses are left to exporter-toolkit.
+func validateListenAddresses(addrs []string, logger *slog.Logger) error {
+	invalid := 0
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "vsock://") {
+			continue
+		}
+		if err := validateListenAddress(addr); err != nil {
+			logger.Error("Invalid listen address, expected host:port", "address", addr, "err", err)
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d listen addresses are invalid", invalid, len(addrs))
+	}
+	return nil
+}
+
 func main() {
 	var (
 		cgroupGlobs = kingpin.Flag(
 			"cgroup.glob",
 			"glob of cgroup directories to scrape (can be specified multiple times)",
 		).Default("/sys/fs/cgroup/*").Strings()
+		cgroupMax = kingpin.Flag(
+			"cgroup.max",
+			"Maximum number of discovered cgroups considered sane, to catch globs matching far more than intended. Use 0 to disable.",
+		).Default("10000").Int()
+		cgroupStrict = kingpin.Flag(
+			"cgroup.strict",
+			"Refuse to start, instead of warning, when a glob root is not on a cgroup filesystem or --cgroup.max is exceeded.",
+		).Bool()
 		metricsPath = kingpin.Flag(
 			"web.telemetry-path",
 			"Path under which to expose metrics.",
@@ -141,9 +436,17 @@ func main() {
 			"web.disable-exporter-metrics",
 			"Exclude metrics about the exporter itself (process_*, go_*).",
 		).Bool()
+		unixSocket = kingpin.Flag(
+			"web.unix-socket",
+			"Path of a Unix domain socket to additionally serve metrics on.",
+		).Default("").String()
+		unixSocketMode = kingpin.Flag(
+			"web.unix-socket-mode",
+			"File permissions of the Unix domain socket, in octal.",
+		).Default("0660").String()
 		maxRequests = kingpin.Flag(
 			"web.max-requests",
-			"Maximum number of parallel scrape requests. Use 0 to disable.",
+			"Maximum number of parallel scrape requests. Further ones wait up to 10s for a slot and are then rejected with 503. Use 0 to disable.",
 		).Default("4").Int()
 		disableDefaultCollectors = kingpin.Flag(
 			"collector.disable-defaults",
@@ -152,10 +455,47 @@ func main() {
 		maxProcs = kingpin.Flag(
 			"runtime.gomaxprocs", "The target number of CPUs Go will run on (GOMAXPROCS)",
 		).Envar("GOMAXPROCS").Default("1").Int()
+		procfsPath = kingpin.Flag(
+			"path.procfs",
+			"procfs mountpoint, used to resolve the cgroup of ?pid= requests.",
+		).Default("/proc").String()
+		cgroupfsPath = kingpin.Flag(
+			"path.cgroupfs",
+			"cgroup2 mountpoint, used to resolve the cgroup of ?pid= requests.",
+		).Default("/sys/fs/cgroup").String()
+		noStore = kingpin.Flag(
+			"web.no-store",
+			"Set Cache-Control: no-store and Pragma: no-cache on metrics responses, so that proxies don't serve stale metrics.",
+		).Default("true").Bool()
+		pushGatewayURL = kingpin.Flag(
+			"push.gateway-url",
+			"URL of a Pushgateway to additionally push the metrics to every --push.interval, e.g. http://pushgateway:9091.",
+		).Default("").String()
+		pushInterval = kingpin.Flag(
+			"push.interval",
+			"Interval of pushes to --push.gateway-url.",
+		).Default("1m").Duration()
+		pushInstance = kingpin.Flag(
+			"push.instance",
+			"Value of the instance label grouping the pushed metrics. Defaults to the hostname.",
+		).Default("").String()
+		remoteWriteURL = kingpin.Flag(
+			"remote-write.url",
+			"Prometheus remote write endpoint to additionally write the metrics to every --remote-write.interval, e.g. http://prometheus:9090/api/v1/write.",
+		).Default("").String()
+		remoteWriteInterval = kingpin.Flag(
+			"remote-write.interval",
+			"Interval of writes to --remote-write.url.",
+		).Default("1m").Duration()
+		runtimeInfo = kingpin.Flag(
+			"web.runtime-info",
+			"Expose cgroupv2_exporter_runtime_info with the cgroup2 mount point, whether the hierarchy is unified and the kernel release.",
+		).Bool()
 		toolkitFlags = kingpinflag.AddFlags(kingpin.CommandLine, ":9100")
 	)
 
 	promslogConfig := &promslog.Config{}
+	collector.RegisterFlags(kingpin.CommandLine)
 	flag.AddFlags(kingpin.CommandLine, promslogConfig)
 	kingpin.Version(version.Print("cgroupv2_exporter"))
 	kingpin.CommandLine.UsageWriter(os.Stdout)
@@ -175,43 +515,75 @@ func main() {
 	runtime.GOMAXPROCS(*maxProcs)
 	logger.Debug("Go MAXPROCS", "procs", runtime.GOMAXPROCS(0))
 
-	var allCgroups []string
-	for _, globPattern := range *cgroupGlobs {
-		matches, err := filepath.Glob(globPattern)
+	collector.SetRootCgroup(*cgroupfsPath)
+	collector.SetProcfs(*procfsPath)
+	collector.DisableAbsentControllers(*cgroupfsPath, logger)
+	allCgroups := collector.DiscoverCgroups(*cgroupGlobs, logger)
+	if included := collector.RegisterFileIncludes(allCgroups, logger); len(included) > 0 {
+		logger.Info("collecting included files", "files", included)
+	}
+	if err := collector.CheckEnabledCollectors(logger); err != nil {
+		logger.Error("Refusing to start", "err", err)
+		os.Exit(1)
+	}
+
+	if len(allCgroups) == 0 {
+		logger.Error("No cgroup directories found from any glob pattern")
+	}
+	if err := collector.CheckDiscovery(*cgroupGlobs, allCgroups, *cgroupMax); err != nil {
+		if *cgroupStrict {
+			logger.Error("Refusing to scrape suspicious cgroup globs", "err", err)
+			os.Exit(1)
+		}
+		logger.Warn("Suspicious cgroup globs, check --cgroup.glob", "err", err)
+	}
+
+	h := newHandler(allCgroups, !*disableExporterMetrics, *maxRequests, logger)
+	h.procfs, h.cgroupfs = *procfsPath, *cgroupfsPath
+	h.noStore = *noStore
+	if *runtimeInfo {
+		info, err := collector.ReadRuntimeInfo(*procfsPath)
 		if err != nil {
-			logger.Error("Failed to expand glob pattern", "pattern", globPattern, "err", err)
-			continue
+			logger.Warn("couldn't fully detect runtime info", "err", err)
 		}
-		for _, match := range matches {
-			fi, err := os.Stat(match)
+		logger.Info("runtime info", "cgroup_mount", info.CgroupMount, "unified", info.Unified, "kernel", info.Kernel)
+		h.runtimeInfo = collector.RuntimeInfoMetric(info)
+	}
+	http.Handle(*metricsPath, h)
+	http.HandleFunc("/-/ready", h.serveReady)
+	if !collector.CgroupfsMounted(*cgroupfsPath) {
+		logger.Warn("No cgroup filesystem mounted, metrics stay empty and /-/ready fails until the exporter is restarted with one mounted", "path", *cgroupfsPath)
+	}
+	if *pushGatewayURL != "" {
+		instance := *pushInstance
+		if instance == "" {
+			hostname, err := os.Hostname()
 			if err != nil {
-				logger.Error("Failed to stat path", "path", match, "err", err)
-				continue
-			}
-			if fi.IsDir() {
-				allCgroups = append(allCgroups, match)
+				logger.Error("Error getting the hostname for the push instance, set --push.instance", "err", err)
+				os.Exit(1)
 			}
+			instance = hostname
+		}
+		if err := h.startPush(context.Background(), *pushGatewayURL, instance, *pushInterval); err != nil {
+			logger.Error("Error starting push", "err", err)
+			os.Exit(1)
 		}
+		logger.Info("Pushing metrics", "url", *pushGatewayURL, "instance", instance, "interval", *pushInterval)
 	}
-
-	if len(allCgroups) == 0 {
-		logger.Error("No cgroup directories found from any glob pattern")
+	if *remoteWriteURL != "" {
+		rw := &remotewrite.Client{
+			URL:          *remoteWriteURL,
+			Interval:     *remoteWriteInterval,
+			WriteMetrics: h.writeMetrics,
+			Logger:       logger.With("component", "remote-write"),
+			MinBackoff:   time.Second,
+			MaxBackoff:   *remoteWriteInterval,
+		}
+		go rw.Run(context.Background())
+		logger.Info("Remote writing metrics", "url", *remoteWriteURL, "interval", *remoteWriteInterval)
 	}
-
-	http.Handle(*metricsPath, newHandler(allCgroups, !*disableExporterMetrics, *maxRequests, logger))
 	if *metricsPath != "/" {
-		landingConfig := web.LandingConfig{
-			Name:        "CgroupV2 Exporter",
-			Description: "Prometheus CgroupV2 Exporter",
-			Version:     version.Info(),
-			Links: []web.LandingLinks{
-				{
-					Address: *metricsPath,
-					Text:    "Metrics",
-				},
-			},
-		}
-		landingPage, err := web.NewLandingPage(landingConfig)
+		landingPage, err := newLandingPage(*metricsPath, h)
 		if err != nil {
 			logger.Error("Error creating landing page", "err", err)
 			os.Exit(1)
@@ -219,8 +591,50 @@ func main() {
 		http.Handle("/", landingPage)
 	}
 
+	if *unixSocket != "" {
+		mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+		if err != nil {
+			logger.Error("Invalid Unix socket mode", "mode", *unixSocketMode, "err", err)
+			os.Exit(1)
+		}
+		l, err := listenUnix(*unixSocket, os.FileMode(mode))
+		if err != nil {
+			logger.Error("Error listening on Unix socket", "path", *unixSocket, "err", err)
+			os.Exit(1)
+		}
+		logger.Info("Listening on", "address", *unixSocket)
+		go func() {
+			if err := (&http.Server{}).Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("Unix socket server error", "err", err)
+			}
+		}()
+
+		// Remove the socket file on shutdown so the next start doesn't trip over it.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-sigs
+			logger.Info("Shutting down", "signal", sig)
+			l.Close()
+			os.Exit(0)
+		}()
+	}
+
+	// With systemd socket activation the listeners are inherited and the
+	// configured addresses are unused.
+	if !*toolkitFlags.WebSystemdSocket {
+		if err := validateListenAddresses(*toolkitFlags.WebListenAddresses, logger); err != nil {
+			logger.Error("Refusing to start", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	server := &http.Server{}
 	if err := web.ListenAndServe(server, toolkitFlags, logger); err != nil {
+		if errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+			logger.Error("Couldn't bind listen address, the address family may not be available on this host (e.g. IPv6 disabled)", "err", err)
+			os.Exit(1)
+		}
 		logger.Error("Server error", "err", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+var logger = promslog.New(&promslog.Config{})
+
+// writeCgroup creates a fake cgroup directory named name under root and
+// populates it with the given interface files.
+func writeCgroup(t *testing.T, root, name string, files map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("Error creating cgroup dir: %v", err)
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+			t.Fatalf("Error writing %s: %v", file, err)
+		}
+	}
+	return dir
+}
+
+// get serves a request for target with h and returns the response.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+	// A stale socket file from a previous run must not prevent startup.
+	if err := os.WriteFile(socket, nil, 0o600); err != nil {
+		t.Fatalf("Error creating stale socket file: %v", err)
+	}
+
+	l, err := listenUnix(socket, 0o660)
+	if err != nil {
+		t.Fatalf("Error listening on Unix socket: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newHandler(nil, false, 1, logger))
+	go http.Serve(l, mux)
+
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Error stating socket: %v", err)
+	}
+	if fi.Mode().Perm() != 0o660 {
+		t.Errorf("Expected socket permissions 0660, got %o", fi.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://unix/metrics")
+	if err != nil {
+		t.Fatalf("Error scraping over Unix socket: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "cgroupv2_exporter_build_info") {
+		t.Errorf("Expected build info in response, got:\n%s", body)
+	}
+
+	l.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed on close, got %v", err)
+	}
+}
+
+func TestValidateListenAddress(t *testing.T) {
+	valid := []string{":9100", "0.0.0.0:9100", "[::1]:9100", "[::]:9100", "[fe80::1%eth0]:9100", "localhost:9100"}
+	for _, addr := range valid {
+		if err := validateListenAddress(addr); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", addr, err)
+		}
+	}
+
+	invalid := []string{"::1:9100", "[::1]", "9100", "[::zz]:9100", "localhost:http-metrics"}
+	for _, addr := range invalid {
+		if err := validateListenAddress(addr); err == nil {
+			t.Errorf("Expected %s to be rejected", addr)
+		}
+	}
+}
+
+func TestServeIPv6Loopback(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer l.Close()
+	if err := validateListenAddress(l.Addr().String()); err != nil {
+		t.Fatalf("Expected bound address %s to be valid, got %v", l.Addr(), err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newHandler(nil, false, 1, logger))
+	go http.Serve(l, mux)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("Error scraping over IPv6: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "cgroupv2_exporter_build_info") {
+		t.Errorf("Expected build info in response, got:\n%s", body)
+	}
+}
+
+func TestValidateListenAddresses(t *testing.T) {
+	var buf strings.Builder
+	l := slog.New(slog.NewTextHandler(&buf, nil))
+	err := validateListenAddresses([]string{":9753", "localhost9753", "[::1]:9753", "::1:9753", "vsock://:9753"}, l)
+	if err == nil {
+		t.Fatal("Expected an error for the invalid addresses")
+	}
+	for _, addr := range []string{"localhost9753", "::1:9753"} {
+		if !strings.Contains(buf.String(), "address="+addr) {
+			t.Errorf("Expected a log message for %s, got:\n%s", addr, buf.String())
+		}
+	}
+	if n := strings.Count(buf.String(), "Invalid listen address"); n != 2 {
+		t.Errorf("Expected 2 log messages, got %d:\n%s", n, buf.String())
+	}
+}
+
+func TestServeMultipleAddresses(t *testing.T) {
+	var listeners []net.Listener
+	var addrs []string
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	if err := validateListenAddresses(addrs, logger); err != nil {
+		t.Fatalf("Expected %v to be valid, got %v", addrs, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", newHandler(nil, false, 1, logger))
+	server := &http.Server{Handler: mux}
+	defer server.Close()
+	go web.ServeMultiple(listeners, server, &web.FlagConfig{
+		WebListenAddresses: &addrs,
+		WebSystemdSocket:   new(false),
+		WebConfigFile:      new(""),
+	}, logger)
+
+	for _, addr := range addrs {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			t.Fatalf("Error scraping %s: %v", addr, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), "cgroupv2_exporter_build_info") {
+			t.Errorf("Expected build info from %s, got:\n%s", addr, body)
+		}
+	}
+}
+
+func TestCgroupfsNotMounted(t *testing.T) {
+	h := newHandler(nil, false, 1, logger)
+	h.cgroupfs = t.TempDir()
+
+	rec := get(h, "/metrics")
+	if !strings.Contains(rec.Body.String(), "cgroupv2_cgroupfs_mounted 0\n") {
+		t.Errorf("Expected cgroupv2_cgroupfs_mounted 0, got:\n%s", rec.Body)
+	}
+
+	rec = get(http.HandlerFunc(h.serveReady), "/-/ready")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without discovered cgroups, got %d", rec.Code)
+	}
+
+	h = newHandler([]string{t.TempDir()}, false, 1, logger)
+	rec = get(http.HandlerFunc(h.serveReady), "/-/ready")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with discovered cgroups, got %d", rec.Code)
+	}
+}
+
+func TestCgroupQuery(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "foo.service", map[string]string{"memory.current": "100\n"}),
+		writeCgroup(t, root, "bar.service", map[string]string{"memory.current": "200\n"}),
+	}
+	h := newHandler(cgroups, false, 1, logger)
+
+	rec := get(h, "/metrics?cgroup="+cgroups[0]+"&collect[]=memory.current")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `cgroupv2_memory_current{cgroup="foo_service"} 100`) {
+		t.Errorf("Expected series of the requested cgroup, got:\n%s", body)
+	}
+	if strings.Contains(body, `cgroup="bar_service"`) {
+		t.Errorf("Expected no series of other cgroups, got:\n%s", body)
+	}
+
+	rec = get(h, "/metrics?cgroup="+cgroups[0]+"/../bar.service/../../../etc")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a cgroup outside the globs, got %d", rec.Code)
+	}
+}
+
+func TestPidQuery(t *testing.T) {
+	tmp := t.TempDir()
+	cgroupfs := filepath.Join(tmp, "cgroup")
+	service := writeCgroup(t, cgroupfs, "app.slice/foo.service", map[string]string{"memory.current": "100\n"})
+	worker := writeCgroup(t, service, "worker", map[string]string{"memory.current": "40\n"})
+	bar := writeCgroup(t, cgroupfs, "app.slice/bar.service", map[string]string{"memory.current": "200\n"})
+	writeCgroup(t, cgroupfs, "excluded.slice", map[string]string{"memory.current": "300\n"})
+	procfs := filepath.Join(tmp, "proc")
+	writeCgroup(t, procfs, "42", map[string]string{"cgroup": "0::/app.slice/foo.service\n"})
+	writeCgroup(t, procfs, "43", map[string]string{"cgroup": "0::/../../etc\n"})
+	writeCgroup(t, procfs, "45", map[string]string{"cgroup": "0::/excluded.slice\n"})
+
+	h := newHandler([]string{service, worker, bar}, false, 1, logger)
+	h.procfs, h.cgroupfs = procfs, cgroupfs
+
+	rec := get(h, "/metrics?pid=42&collect[]=memory.current")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="foo_service"} 100`,
+		`cgroupv2_memory_current{cgroup="worker"} 40`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `cgroup="bar_service"`) {
+		t.Errorf("Expected no series outside the process' cgroup, got:\n%s", body)
+	}
+
+	// 45 is in a cgroup outside of the globs.
+	for _, pid := range []string{"43", "44", "45", "self"} {
+		if rec := get(h, "/metrics?pid="+pid); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for pid %s, got %d", pid, rec.Code)
+		}
+	}
+}
+
+func TestExporterMetricsQuery(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "foo.service", map[string]string{"memory.current": "100\n"})}
+	h := newHandler(cgroups, true, 1, logger)
+
+	// Collectors are cached across handlers, so select the cgroup explicitly.
+	target := "/metrics?cgroup=" + cgroups[0]
+	with := get(h, target).Body.String()
+	without := get(h, target+"&exporter-metrics=false").Body.String()
+	for name, body := range map[string]string{"with": with, "without": without} {
+		if !strings.Contains(body, `cgroupv2_memory_current{cgroup="foo_service"} 100`) {
+			t.Errorf("Expected cgroup metrics %s exporter metrics, got:\n%s", name, body)
+		}
+	}
+	if !strings.Contains(with, "go_goroutines") {
+		t.Errorf("Expected exporter metrics by default, got:\n%s", with)
+	}
+	if strings.Contains(without, "go_goroutines") || strings.Contains(without, "process_") {
+		t.Errorf("Expected no exporter metrics with exporter-metrics=false, got:\n%s", without)
+	}
+
+	h = newHandler(cgroups, false, 1, logger)
+	if body := get(h, target+"&exporter-metrics=true").Body.String(); !strings.Contains(body, "go_goroutines") {
+		t.Errorf("Expected exporter-metrics=true to override --web.disable-exporter-metrics, got:\n%s", body)
+	}
+	if rec := get(h, "/metrics?exporter-metrics=maybe"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid exporter-metrics value, got %d", rec.Code)
+	}
+}
+
+func TestCollectFilterErrors(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "foo.service", map[string]string{"memory.current": "100\n"})}
+	h := newHandler(cgroups, false, 1, logger)
+
+	rec := get(h, "/metrics?collect[]=memory.curent")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown collector, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{"missing collector: memory.curent, did you mean memory.current?", "Enabled collectors: ", "cpu.stat"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in the response, got:\n%s", expected, body)
+		}
+	}
+	if body := get(h, "/metrics?collect[]=nonsense").Body.String(); strings.Contains(body, "did you mean") {
+		t.Errorf("Expected no suggestion for a name unlike any collector, got:\n%s", body)
+	}
+
+	rec = get(h, "/metrics?collect[]=memory.stat")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a disabled collector, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "disabled collector: memory.stat, enable it with --collector.memory.stat") {
+		t.Errorf("Expected a hint to enable memory.stat, got:\n%s", body)
+	}
+}
+
+func TestNoStoreHeaders(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "foo.service", map[string]string{"memory.current": "100\n"})}
+	h := newHandler(cgroups, false, 1, logger)
+
+	for _, target := range []string{"/metrics", "/metrics?cgroup=" + cgroups[0], "/metrics?exporter-metrics=maybe"} {
+		rec := get(h, target)
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Expected Cache-Control no-store for %s, got %q", target, got)
+		}
+		if got := rec.Header().Get("Pragma"); got != "no-cache" {
+			t.Errorf("Expected Pragma no-cache for %s, got %q", target, got)
+		}
+	}
+
+	h.noStore = false
+	if got := get(h, "/metrics").Header().Get("Cache-Control"); got != "" {
+		t.Errorf("Expected no Cache-Control with --no-web.no-store, got %q", got)
+	}
+}
+
+func TestScrapesRejected(t *testing.T) {
+	h := newHandler(nil, false, 1, logger)
+
+	if body := get(h, "/metrics").Body.String(); !strings.Contains(body, "cgroupv2_exporter_scrapes_in_flight 1") ||
+		!strings.Contains(body, "cgroupv2_exporter_scrapes_rejected_total 0") {
+		t.Errorf("Expected one scrape in flight and none rejected, got:\n%s", body)
+	}
+
+	// Occupy the only slot, as a scrape in progress would.
+	h.scrapeWait = 10 * time.Millisecond
+	h.scrapeSem <- struct{}{}
+	for range 2 {
+		if rec := get(h, "/metrics"); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 at the limit, got %d", rec.Code)
+		}
+	}
+
+	// A scrape cancelled while waiting isn't counted as rejected.
+	h.scrapeWait = 5 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+	if n := h.rejected.Load(); n != 2 {
+		t.Errorf("Expected a cancelled scrape not to count as rejected, got %d rejected", n)
+	}
+
+	// A scrape waits for the slot to be freed.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-h.scrapeSem
+	}()
+	if rec := get(h, "/metrics"); rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200 once the slot is freed, got %d", rec.Code)
+	}
+
+	if body := get(h, "/metrics").Body.String(); !strings.Contains(body, "cgroupv2_exporter_scrapes_rejected_total 2") {
+		t.Errorf("Expected 2 rejected scrapes, got:\n%s", body)
+	}
+}
+
+func TestPush(t *testing.T) {
+	type push struct {
+		method, path, body string
+	}
+	pushes := make(chan push, 10)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case pushes <- push{r.Method, r.URL.Path, string(body)}:
+		default:
+		}
+	}))
+	defer gateway.Close()
+
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "foo.service", map[string]string{"memory.current": "100\n"})}
+	h := newHandler(cgroups, false, 1, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := h.startPush(ctx, gateway.URL+"/", "host a", 10*time.Millisecond); err != nil {
+		t.Fatalf("Error starting push: %v", err)
+	}
+
+	select {
+	case p := <-pushes:
+		if p.method != http.MethodPut {
+			t.Errorf("Expected method PUT, got %s", p.method)
+		}
+		if expected := "/metrics/job/cgroupv2_exporter/instance/host a"; p.path != expected {
+			t.Errorf("Expected grouping key path %s, got %s", expected, p.path)
+		}
+		if !strings.Contains(p.body, "cgroupv2_exporter_build_info") {
+			t.Errorf("Expected the exporter metrics to be pushed, got:\n%s", p.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a push, got none")
+	}
+
+	if err := h.startPush(ctx, gateway.URL, "", time.Second); err == nil {
+		t.Errorf("Expected an error for an empty instance")
+	}
+}
+
+func TestGroupingKey(t *testing.T) {
+	for value, expected := range map[string]string{
+		"host-a":   "instance/host-a",
+		"host a":   "instance/host%20a",
+		"ns/pod-0": "instance@base64/bnMvcG9kLTA",
+		"/leading": "instance@base64/L2xlYWRpbmc",
+	} {
+		if got := groupingKey("instance", value); got != expected {
+			t.Errorf("groupingKey(instance, %q) = %q, expected %q", value, got, expected)
+		}
+	}
+}
+
+func TestFDMetrics(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "foo.service", nil)}
+	h := newHandler(cgroups, false, 1, logger)
+
+	body := get(h, "/metrics").Body.String()
+	values := make(map[string]float64)
+	for _, line := range strings.Split(body, "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if !ok || (name != "cgroupv2_exporter_open_fds" && name != "cgroupv2_exporter_max_fds") {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", line, err)
+		}
+		values[name] = v
+	}
+	if v, ok := values["cgroupv2_exporter_open_fds"]; !ok || v <= 0 {
+		t.Errorf("Expected cgroupv2_exporter_open_fds, got:\n%s", body)
+	}
+	if v, ok := values["cgroupv2_exporter_max_fds"]; !ok || v <= 0 {
+		t.Errorf("Expected positive cgroupv2_exporter_max_fds, got:\n%s", body)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "a.service", nil),
+		writeCgroup(t, root, "b.service", nil),
+	}
+	h := newHandler(cgroups, false, 1, logger)
+	landingPage, err := newLandingPage("/metrics", h)
+	if err != nil {
+		t.Fatalf("Error creating landing page: %v", err)
+	}
+
+	rec := get(landingPage, "/")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{"<li>memory.current</li>", "<li>cpu.stat</li>", "Discovered cgroups: 2"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q on the landing page, got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "<li>memory.stat</li>") {
+		t.Errorf("Expected disabled collector memory.stat not to be listed")
+	}
+}
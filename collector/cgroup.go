@@ -0,0 +1,292 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/asama-ai/cgroupv2_exporter/parsers"
+)
+
+// NewCgroupMaxDescendantsCollector reports the maximum allowed number of descendant
+// cgroups, +Inf when unlimited ("max").
+func NewCgroupMaxDescendantsCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cgroup.max.descendants"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
+// NewCgroupMaxDepthCollector reports the maximum allowed descent depth below the
+// cgroup, +Inf when unlimited ("max").
+func NewCgroupMaxDepthCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cgroup.max.depth"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
+// rootCgroup is the root cgroup, the mount point of the cgroup2 filesystem.
+var rootCgroup = "/sys/fs/cgroup"
+
+const rootCgroupLabel = "root"
+
+// SetRootCgroup sets the root cgroup, which unfiltered scrapes of the
+// cgroup.stat collector read besides the discovered cgroups.
+func SetRootCgroup(dir string) {
+	rootCgroup = filepath.Clean(dir)
+}
+
+// isRootCgroup reports whether dirName is the root cgroup, for the collectors of
+// files only the root cgroup has.
+func isRootCgroup(dirName string) bool {
+	return filepath.Clean(dirName) == rootCgroup
+}
+
+// withRootCgroup returns cgroups with root prepended unless already among them.
+func withRootCgroup(root string, cgroups []string) []string {
+	if slices.ContainsFunc(cgroups, func(dir string) bool { return filepath.Clean(dir) == root }) {
+		return cgroups
+	}
+	return append([]string{root}, cgroups...)
+}
+
+// NewCgroupStatCollector reports the number of descendant cgroups, live and
+// dying, of every cgroup. Unfiltered scrapes include the root cgroup, labelled
+// cgroup="root", whose counts are totals for the host and so a signal for
+// cgroup churn.
+func NewCgroupStatCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cgroup.stat"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.FlatKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		rootDir:   rootCgroup,
+	}, nil
+}
+
+// cgroupTypeReader returns a function reading the type of a cgroup from
+// cgroup.type, e.g. "domain" or "threaded", through the read path of a file
+// collector with its cache and --collector.file-timeout. It returns "" if the
+// type can't be read, as for the root cgroup, which has no cgroup.type.
+func cgroupTypeReader(logger *slog.Logger) func(dirName string) string {
+	file := "cgroup.type"
+	fileLogger := logger.With("file", file)
+	reader := &Cgroupv2FileCollector{
+		parser: &parsers.StateParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			LabelName:    "type",
+		},
+		fileName: file,
+		logger:   fileLogger,
+	}
+	return func(dirName string) string {
+		metricsFromFile, err := reader.readFile(filepath.Join(dirName, file))
+		if err != nil || len(metricsFromFile) == 0 {
+			fileLogger.Debug("couldn't read cgroup type", "dir", dirName, "err", err)
+			return ""
+		}
+		return metricsFromFile[0].Labels["type"]
+	}
+}
+
+// NewCgroupThreadsCollector reports the number of threads of threaded cgroups,
+// the TIDs listed in cgroup.threads. Domain cgroups are skipped: their thread
+// count is covered by pids.current.
+func NewCgroupThreadsCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cgroup.threads"
+	fileLogger := logger.With("file", file)
+	typeOf := cgroupTypeReader(logger)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.LineCountParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		cgroupFilter: func(dirName string) bool {
+			switch typeOf(dirName) {
+			case "threaded", "domain threaded":
+				return true
+			}
+			return false
+		},
+	}, nil
+}
+
+// NewCgroupProcsCollector reports the number of processes in the cgroup, the
+// PIDs listed in cgroup.procs. Unlike pids.current it doesn't count threads.
+func NewCgroupProcsCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cgroup.procs"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.LineCountParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
+// NewCgroupPressureCollector reports whether PSI accounting is enabled for the
+// cgroup (1) or was disabled by writing 0 to cgroup.pressure.
+func NewCgroupPressureCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cgroup.pressure"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file) + "_enabled",
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
+// pressureEnabledReader returns a function reporting whether PSI accounting is
+// enabled for a cgroup, reading cgroup.pressure through the read path of a file
+// collector with its cache and --collector.file-timeout. Kernels without
+// cgroup.pressure always account pressure, and a file that can't be read
+// doesn't hold back the PSI file itself.
+func pressureEnabledReader(logger *slog.Logger) func(dirName string) bool {
+	file := "cgroup.pressure"
+	fileLogger := logger.With("file", file)
+	reader := &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		fileName: file,
+		logger:   fileLogger,
+	}
+	return func(dirName string) bool {
+		metricsFromFile, err := reader.readFile(filepath.Join(dirName, file))
+		if err != nil || len(metricsFromFile) == 0 {
+			fileLogger.Debug("couldn't read whether pressure is enabled", "dir", dirName, "err", err)
+			return true
+		}
+		return metricsFromFile[0].Value != 0
+	}
+}
+
+// leafCollector reports whether a cgroup has no child cgroups, as many
+// controller files only carry meaningful values at the leaves.
+type leafCollector struct {
+	dirNames []string
+	logger   *slog.Logger
+}
+
+func NewCgroupIsLeafCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	return &leafCollector{dirNames: cgroups, logger: logger}, nil
+}
+
+func (lc *leafCollector) checkAvailable(cgroup string) error {
+	_, err := os.ReadDir(cgroup)
+	return err
+}
+
+func (lc *leafCollector) Update(metricSet *metrics.Set) error {
+	var errs []error
+	for _, dirName := range lc.dirNames {
+		entries, err := os.ReadDir(dirName)
+		if err != nil {
+			lc.logger.Debug("failed to list cgroup", "dir", dirName, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		leaf := 1.0
+		for _, entry := range entries {
+			if entry.IsDir() {
+				leaf = 0
+				break
+			}
+		}
+		id := formatMetricID(joinFQ("cgroup_is_leaf"), cgroupBaseLabels(dirName))
+		metricSet.GetOrCreateGauge(id, nil).Set(leaf)
+	}
+	return errors.Join(errs...)
+}
+
+type depthCollector struct {
+	dirNames []string
+	logger   *slog.Logger
+}
+
+// NewCgroupDepthCollector reports the depth of every cgroup below the root of
+// the glob that discovered it, to analyze the shape of the hierarchy.
+func NewCgroupDepthCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	return &depthCollector{dirNames: cgroups, logger: logger}, nil
+}
+
+func (dc *depthCollector) checkAvailable(cgroup string) error {
+	if d := cgroupDepths.Load(); d != nil {
+		if _, ok := (*d)[cgroup]; ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("no depth known for %s: %w", cgroup, fs.ErrNotExist)
+}
+
+func (dc *depthCollector) Update(metricSet *metrics.Set) error {
+	var depths map[string]int
+	if d := cgroupDepths.Load(); d != nil {
+		depths = *d
+	}
+	found := false
+	for _, dirName := range dc.dirNames {
+		depth, ok := depths[dirName]
+		if !ok {
+			// Not discovered from a glob, e.g. requested with ?pid=.
+			dc.logger.Debug("no depth known, skipping cgroup", "dir", dirName)
+			continue
+		}
+		found = true
+		id := formatMetricID(joinFQ("cgroup_depth"), cgroupBaseLabels(dirName))
+		metricSet.GetOrCreateGauge(id, nil).Set(float64(depth))
+	}
+	if !found {
+		return ErrNoData
+	}
+	return nil
+}
@@ -1,21 +1,35 @@
 package collector
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/alecthomas/units"
 	"github.com/asama-ai/cgroupv2_exporter/parsers"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sync/singleflight"
 )
 
 // Namespace defines the common namespace to be used by all metrics.
@@ -26,30 +40,262 @@ var (
 	initiatedCollectorsMtx = sync.Mutex{}
 	initiatedCollectors    = make(map[string]Collector)
 	collectorState         = make(map[string]*bool)
+	defaultState           = make(map[string]bool)
 	forcedCollectors       = map[string]bool{} // collectors which have been explicitly enabled or disabled
+
+	// Options shared by all collectors. They hold the defaults until bound to
+	// command-line flags with RegisterFlags.
+	dropNonFinite           = new(bool)
+	compactScrapeMetrics    = new(bool)
+	zeroFill                = new(bool)
+	fileTimeout             = new(time.Duration)
+	maxFileSize             = new(units.Base2Bytes)
+	psiLayout               = new(layoutLabel)
+	skipDisabledControllers = new(bool)
+	parseUnits              = new(bool)
+	psiHistogram            = new(bool)
+	memoryStatLayout        = new(layoutLabel)
+	memoryStatReclaimKind   = new(bool)
+	cacheTTL                = new(time.Duration)
+	rawOnParseFailure       = new(bool)
+	userSlices              = new(true)
+	sampleRate              = new(1.0)
+	sampleSeed              = new(uint64)
+	counterOverrideSpecs    = new([]string)
+	counterOverrides        []counterOverride
+	unitLabel               = new(bool)
+	allowEmpty              = new(bool)
+	breakerFailures         = new(int)
+	breakerRetryInterval    = new(5 * time.Minute)
+	staticLabelSpecs        = new([]string)
+	staticLabels            map[string]string
+	dockerLabels            = new(bool)
 )
 
 func registerCollector(collector string, isDefaultEnabled bool, factory func(logger *slog.Logger, cgroups []string) (Collector, error)) {
-	var helpDefaultState string
-	if isDefaultEnabled {
-		helpDefaultState = "enabled"
-	} else {
-		helpDefaultState = "disabled"
+	enabled := isDefaultEnabled
+	collectorState[collector] = &enabled
+	defaultState[collector] = isDefaultEnabled
+
+	factories[collector] = factory
+}
+
+// RegisterFlags binds the collector options and a --collector.<name> flag per
+// registered collector to app. The collector package registers no flags on its
+// own, so that it can be imported as a library.
+func RegisterFlags(app *kingpin.Application) {
+	app.Flag(
+		"web.drop-inf",
+		"Drop metrics whose value is +Inf, -Inf or NaN instead of exposing them.",
+	).Default("false").BoolVar(dropNonFinite)
+	app.Flag(
+		"web.compact-scrape-metrics",
+		"Expose one series per collector, the scrape duration with a success=\"true\"|\"false\" label, instead of separate duration and success series.",
+	).Default("false").BoolVar(compactScrapeMetrics)
+	app.Flag(
+		"collector.zero-fill",
+		"Report 0 for usage gauges of cgroups lacking the file, so that series stay continuous.",
+	).Default("false").BoolVar(zeroFill)
+	app.Flag(
+		"collector.file-timeout",
+		"Give up reading a single cgroup file after this duration and skip that cgroup. Use 0 to disable.",
+	).Default("0s").DurationVar(fileTimeout)
+	app.Flag(
+		"collector.max-file-size",
+		"Read at most this many bytes of a cgroup file, e.g. 1MiB, dropping the rest after the last complete line. Files that are only counted, like cgroup.procs, are streamed and not capped. Use 0 to disable.",
+	).Default("0").BytesVar(maxFileSize)
+	app.Flag(
+		"collector.cache-ttl",
+		"Share the file reads of a collector between scrapes within this duration, e.g. an unfiltered and a collect[] filtered scrape of the same interval. Use 0 to disable.",
+	).Default("0s").DurationVar(cacheTTL)
+	app.Flag(
+		"collector.psi-layout",
+		"How to expose PSI some/full lines: as a type label (label) or in the metric name (name).",
+	).Default(layoutLabel).EnumVar(psiLayout, layoutLabel, layoutName)
+	app.Flag(
+		"collector.memory-stat-layout",
+		"How to expose memory.stat keys: as a stat label of one gauge and one counter family (label) or in the metric name (name).",
+	).Default(layoutLabel).EnumVar(memoryStatLayout, layoutLabel, layoutName)
+	app.Flag(
+		"collector.memory-stat-reclaim-kind",
+		"Expose the pgscan_<kind> and pgsteal_<kind> keys of memory.stat as pgscan and pgsteal with a reclaim_kind label, e.g. kswapd or direct, replacing the pgscan and pgsteal totals.",
+	).Default("false").BoolVar(memoryStatReclaimKind)
+	app.Flag(
+		"collector.cgroup-label-template",
+		"Go text/template computing the cgroup label from .Name (sanitized basename), .Basename, .Path, .Parent and .Depth, e.g. '{{.Parent | sanitize}}_{{.Name}}'. Defaults to .Name.",
+	).Default("").Action(func(*kingpin.ParseContext) error {
+		return setCgroupLabelTemplate(*cgroupLabelTemplateText)
+	}).StringVar(cgroupLabelTemplateText)
+	app.Flag(
+		"collector.docker-labels",
+		"Add a container_id label with the short ID of Docker and containerd containers, from cgroups named docker-<id>.scope (systemd driver) or <id> (cgroupfs driver).",
+	).Default("false").BoolVar(dockerLabels)
+	app.Flag(
+		"collector.counter-override",
+		"Expose metrics whose name matches a pattern as counter or gauge, as pattern=counter|gauge, e.g. 'cgroupv2_memory_stat_*=gauge' (can be specified multiple times).",
+	).Action(func(*kingpin.ParseContext) error {
+		return setCounterOverrides(*counterOverrideSpecs)
+	}).StringsVar(counterOverrideSpecs)
+	app.Flag(
+		"collector.breaker-failures",
+		"Stop running a collector after this many consecutive failed scrapes until --collector.breaker-retry-interval has passed. Use 0 to disable.",
+	).Default("0").IntVar(breakerFailures)
+	app.Flag(
+		"collector.breaker-retry-interval",
+		"Time after which a collector stopped by --collector.breaker-failures is tried again.",
+	).Default("5m").DurationVar(breakerRetryInterval)
+	app.Flag(
+		"collector.allow-empty",
+		"Start even if no collector is enabled, e.g. after --collector.disable-defaults without enabling any, with a warning instead of an error.",
+	).Default("false").BoolVar(allowEmpty)
+	app.Flag(
+		"collector.unit-label",
+		"Add a unit label (bytes, microseconds, ratio) to the metrics of files with a known unit.",
+	).Default("false").BoolVar(unitLabel)
+	app.Flag(
+		"collector.static-label",
+		"Label to add to every metric of the collectors, as name=value, e.g. 'datacenter=fra1' (can be specified multiple times).",
+	).Action(func(*kingpin.ParseContext) error {
+		return setStaticLabels(*staticLabelSpecs)
+	}).StringsVar(staticLabelSpecs)
+	app.Flag(
+		"collector.file-include",
+		"Glob of cgroup file names, e.g. 'memory.*', to collect with a parser chosen from their format unless a collector covers them already (can be specified multiple times).",
+	).StringsVar(fileIncludes)
+	app.Flag(
+		"collector.raw-on-parse-failure",
+		"Report cgroupv2_raw_file{file,cgroup} 1 for files that are read but of which no line parses, so that their presence stays visible.",
+	).Default("false").BoolVar(rawOnParseFailure)
+	app.Flag(
+		"collector.sample-rate",
+		"Fraction of the discovered cgroups to scrape, chosen deterministically by hashing their paths, to bound cardinality and scrape time on very large hosts.",
+	).Default("1").Action(func(*kingpin.ParseContext) error {
+		return checkSampleRate(*sampleRate)
+	}).Float64Var(sampleRate)
+	app.Flag(
+		"collector.sample-seed",
+		"Seed of the hash choosing the cgroups with --collector.sample-rate. Changing it rotates the sampled subset.",
+	).Default("0").Uint64Var(sampleSeed)
+	app.Flag(
+		"collector.user-slices",
+		"Include cgroups in user.slice, i.e. user sessions and user@<uid>.service managers. Their files may not be readable to the exporter's user; such permission failures are counted but don't fail the collector.",
+	).Default("true").BoolVar(userSlices)
+	app.Flag(
+		"collector.skip-disabled-controllers",
+		"Only read files of controllers listed in each cgroup's cgroup.controllers.",
+	).Default("false").BoolVar(skipDisabledControllers)
+	app.Flag(
+		"collector.psi-histogram",
+		"Record the increase of PSI total= stall time between scrapes into a histogram per cgroup and type.",
+	).Default("false").BoolVar(psiHistogram)
+	app.Flag(
+		"collector.parse-units",
+		"Accept byte sizes of the memory files with K/M/G or Ki/Mi/Gi suffixes, e.g. from simulated cgroupfs. The kernel writes plain integers.",
+	).Default("false").BoolVar(parseUnits)
+
+	names := make([]string, 0, len(defaultState))
+	for name := range defaultState {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, collector := range names {
+		var helpDefaultState string
+		if defaultState[collector] {
+			helpDefaultState = "enabled"
+		} else {
+			helpDefaultState = "disabled"
+		}
 
-	flagName := fmt.Sprintf("collector.%s", collector)
-	flagHelp := fmt.Sprintf("Enable the %s collector (default: %s).", collector, helpDefaultState)
-	defaultValue := fmt.Sprintf("%v", isDefaultEnabled)
+		flagName := fmt.Sprintf("collector.%s", collector)
+		flagHelp := fmt.Sprintf("Enable the %s collector (default: %s).", collector, helpDefaultState)
+		defaultValue := fmt.Sprintf("%v", defaultState[collector])
 
-	flag := kingpin.Flag(flagName, flagHelp).Default(defaultValue).Action(collectorFlagAction(collector)).Bool()
-	collectorState[collector] = flag
+		app.Flag(flagName, flagHelp).Default(defaultValue).Action(collectorFlagAction(collector)).BoolVar(collectorState[collector])
+	}
+}
 
-	factories[collector] = factory
+// RegisteredCollectors returns the names of all known collectors and whether
+// each one is enabled by default.
+func RegisteredCollectors() map[string]bool {
+	registered := make(map[string]bool, len(defaultState))
+	for name, enabled := range defaultState {
+		registered[name] = enabled
+	}
+	return registered
+}
+
+// RegistryOpts configures a collector created with NewRegistry.
+type RegistryOpts struct {
+	// Cgroups are the cgroup directories to collect from.
+	Cgroups []string
+	// Collectors are the names of the collectors to enable. If empty, the
+	// collectors enabled by default are used.
+	Collectors []string
+	// Logger defaults to discarding all output.
+	Logger *slog.Logger
+}
+
+// NewRegistry creates a Cgroup2Collector for embedding the collectors in another
+// program. Unlike NewCgroupv2Collector it ignores the --collector.<name> flags
+// and does not share collectors with other callers.
+func NewRegistry(opts RegistryOpts) (*Cgroup2Collector, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	names := opts.Collectors
+	if len(names) == 0 {
+		for name, enabled := range defaultState {
+			if enabled {
+				names = append(names, name)
+			}
+		}
+	}
+
+	collectors := make(map[string]Collector, len(names))
+	for _, name := range names {
+		factory, ok := factories[name]
+		if !ok {
+			return nil, fmt.Errorf("missing collector: %s", name)
+		}
+		c, err := factory(logger.With("collector", name), opts.Cgroups)
+		if err != nil {
+			return nil, err
+		}
+		collectors[name] = c
+	}
+	return &Cgroup2Collector{Collectors: collectors, logger: logger}, nil
 }
 
 type Cgroup2Collector struct {
 	Collectors map[string]Collector
 	logger     *slog.Logger
+	// subset marks collectors of a subset of the cgroups, as for ?cgroup=.
+	// Their failures don't count towards the circuit breakers.
+	subset bool
+}
+
+// Gather scrapes all collectors and returns the result as metric families
+// sorted by name, so that a Cgroup2Collector, e.g. from NewRegistry, serves as
+// prometheus.Gatherer for tests and tools independent of the HTTP handler.
+// The families are untyped, as the exposition carries no TYPE lines.
+func (cgc *Cgroup2Collector) Gather() ([]*dto.MetricFamily, error) {
+	ms := metrics.NewSet()
+	cgc.Scrape(ms)
+	var buf bytes.Buffer
+	ms.WritePrometheus(&buf)
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		result = append(result, mf)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result, nil
 }
 
 type Cgroupv2FileCollector struct {
@@ -58,14 +304,165 @@ type Cgroupv2FileCollector struct {
 	fileName  string
 	logger    *slog.Logger
 	isCounter func(metricName string, labels map[string]string) bool
+	// zeroFill marks single-value usage gauges that may be reported as 0 for
+	// cgroups lacking the file when --collector.zero-fill is set.
+	zeroFill bool
+	// extraMetrics, if set, derives additional metrics from those parsed from
+	// the file of a single cgroup.
+	extraMetrics func(metricsFromFile []parsers.Metric) []parsers.Metric
+	// stallHistogram marks PSI files whose total= stall time feeds the
+	// histograms of --collector.psi-histogram.
+	stallHistogram bool
+	// pressureEnabled, if set, tells whether PSI accounting is enabled for a
+	// cgroup. PSI files of cgroups with it disabled are skipped.
+	pressureEnabled func(dirName string) bool
+	// rootDir, if set, is the root cgroup, labelled cgroup="root" rather than
+	// after its directory. Unfiltered scrapes read it besides the discovered
+	// cgroups.
+	rootDir string
+	// cgroupLabels, if set, returns labels added to all metrics of a cgroup.
+	cgroupLabels func(dirName string) map[string]string
+	// cgroupFilter, if set, selects the cgroups whose file is read, e.g. by
+	// their cgroup.type. The others are skipped silently.
+	cgroupFilter func(dirName string) bool
+
+	// readsMtx guards reads, the results of recent file reads by path, shared
+	// between scrapes within --collector.cache-ttl, and prunedAt, when expired
+	// reads were last dropped.
+	readsMtx sync.Mutex
+	reads    map[string]cachedRead
+	prunedAt time.Time
+	// readGroup makes concurrent misses of a path share one read.
+	readGroup singleflight.Group
+
+	// deniedMtx guards denied, the cgroups whose file could not be opened for
+	// lack of permission, so that this is reported once rather than every scrape.
+	deniedMtx sync.Mutex
+	denied    map[string]bool
 }
 
 // isPressureTotalField matches cgroup *.pressure cumulative stall time (the total=... field).
-// NestedKeyValueParser uses label "type" for some|full; the field name is the metric suffix (_total).
-func isPressureTotalField(metricName string) bool {
+// NestedKeyValueParser uses label "type" for some|full; the field is either carried in a
+// "window" label (avg10, avg60, avg300, total) or, by default, as the metric suffix (_total).
+func isPressureTotalField(metricName string, labels map[string]string) bool {
+	if window, ok := labels["window"]; ok {
+		return window == "total"
+	}
 	return strings.HasSuffix(metricName, "_total")
 }
 
+// counterOverride forces the type of the metrics whose name matches pattern.
+type counterOverride struct {
+	pattern string
+	counter bool
+}
+
+// setCounterOverrides parses --collector.counter-override specs of the form
+// pattern=counter|gauge, with pattern in path.Match syntax.
+func setCounterOverrides(specs []string) error {
+	overrides := make([]counterOverride, 0, len(specs))
+	for _, spec := range specs {
+		pattern, typ, ok := strings.Cut(spec, "=")
+		if !ok || (typ != "counter" && typ != "gauge") {
+			return fmt.Errorf("invalid counter override %q, expected pattern=counter|gauge", spec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid counter override %q: %w", spec, err)
+		}
+		overrides = append(overrides, counterOverride{pattern: pattern, counter: typ == "counter"})
+	}
+	counterOverrides = overrides
+	return nil
+}
+
+// overrideIsCounter returns the type forced for the metric fullName by the
+// first matching --collector.counter-override, if any.
+func overrideIsCounter(fullName string) (counter, ok bool) {
+	for _, o := range counterOverrides {
+		if matched, _ := path.Match(o.pattern, fullName); matched {
+			return o.counter, true
+		}
+	}
+	return false, false
+}
+
+const (
+	unitBytes        = "bytes"
+	unitMicroseconds = "microseconds"
+	unitRatio        = "ratio"
+)
+
+// fileUnits maps interface files to the unit of their values for
+// --collector.unit-label. Of the microseconds files only the *_usec stats are
+// times, the others are counts.
+var fileUnits = map[string]string{
+	"memory.current":       unitBytes,
+	"memory.min":           unitBytes,
+	"memory.low":           unitBytes,
+	"memory.high":          unitBytes,
+	"memory.max":           unitBytes,
+	"memory.peak":          unitBytes,
+	"memory.swap.current":  unitBytes,
+	"memory.swap.max":      unitBytes,
+	"memory.swap.peak":     unitBytes,
+	"memory.zswap.current": unitBytes,
+	"memory.zswap.max":     unitBytes,
+	"cpu.stat":             unitMicroseconds,
+	"cpu.stat.local":       unitMicroseconds,
+}
+
+// metricUnit returns the unit of a metric parsed from file, or "" if unknown.
+func metricUnit(file string, labels map[string]string) string {
+	unit := fileUnits[file]
+	if unit == unitMicroseconds && !strings.HasSuffix(labels["stat"], "_usec") {
+		return ""
+	}
+	return unit
+}
+
+// setStaticLabels parses --collector.static-label specs of the form name=value.
+// The cgroup label and reserved names starting with __ can't be overridden.
+func setStaticLabels(specs []string) error {
+	labels := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("invalid static label %q, expected name=value", spec)
+		}
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, "__") || name == "cgroup" {
+			return fmt.Errorf("invalid static label name %q", name)
+		}
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("invalid static label value %q, expected UTF-8", value)
+		}
+		if _, dup := labels[name]; dup {
+			return fmt.Errorf("static label %q specified more than once", name)
+		}
+		labels[name] = value
+	}
+	staticLabels = labels
+	return nil
+}
+
+// ErrNoCollectors is returned by CheckEnabledCollectors when no collector is
+// enabled, so every scrape would be empty.
+var ErrNoCollectors = errors.New("no collectors enabled, enable some with --collector.<name>")
+
+// CheckEnabledCollectors returns ErrNoCollectors if no collector is enabled,
+// unless --collector.allow-empty is set, in which case it only warns.
+func CheckEnabledCollectors(logger *slog.Logger) error {
+	for _, enabled := range collectorState {
+		if *enabled {
+			return nil
+		}
+	}
+	if *allowEmpty {
+		logger.Warn("No collectors enabled, metrics will only describe the exporter itself")
+		return nil
+	}
+	return ErrNoCollectors
+}
+
 // DisableDefaultCollectors sets the collector state to false for all collectors which
 // have not been explicitly enabled on the command line.
 func DisableDefaultCollectors() {
@@ -76,6 +473,58 @@ func DisableDefaultCollectors() {
 	}
 }
 
+// knownControllers are the cgroup v2 controllers listed in cgroup.controllers.
+var knownControllers = map[string]bool{
+	"cpu":     true,
+	"cpuset":  true,
+	"io":      true,
+	"memory":  true,
+	"pids":    true,
+	"hugetlb": true,
+	"rdma":    true,
+	"misc":    true,
+}
+
+// controllerCoreFiles are files named after a controller that the kernel
+// provides in every cgroup, whether the controller is available or not.
+var controllerCoreFiles = map[string]bool{
+	"cpu.stat":       true,
+	"cpu.stat.local": true,
+}
+
+// DisableAbsentControllers reads the controllers available on this host from
+// the cgroup.controllers file at the cgroupfs root and disables the collectors
+// of the other controllers, e.g. all io.* collectors if io isn't listed, as
+// they would fail on every scrape. Collectors explicitly enabled on the command
+// line are kept. It returns the names of the disabled collectors.
+func DisableAbsentControllers(cgroupfs string, logger *slog.Logger) []string {
+	data, err := os.ReadFile(filepath.Join(cgroupfs, "cgroup.controllers"))
+	if err != nil {
+		logger.Debug("couldn't read available controllers, keeping all collectors", "err", err)
+		return nil
+	}
+	available := make(map[string]bool)
+	for _, controller := range strings.Fields(string(data)) {
+		available[controller] = true
+	}
+
+	var disabled []string
+	for name, enabled := range collectorState {
+		controller, _, _ := strings.Cut(name, ".")
+		if !*enabled || forcedCollectors[name] || available[controller] || !knownControllers[controller] ||
+			controllerCoreFiles[name] || strings.HasSuffix(name, ".pressure") {
+			continue
+		}
+		*enabled = false
+		disabled = append(disabled, name)
+	}
+	sort.Strings(disabled)
+	if len(disabled) > 0 {
+		logger.Info("disabling collectors of controllers not available on this host", "collectors", disabled)
+	}
+	return disabled
+}
+
 // collectorFlagAction generates a new action function for the given collector
 // to track whether it has been explicitly enabled or disabled from the command line.
 // A new action function is needed for each collector flag because the ParseContext
@@ -89,51 +538,338 @@ func collectorFlagAction(collector string) func(ctx *kingpin.ParseContext) error
 }
 
 func NewCgroupv2Collector(cgroups []string, logger *slog.Logger, filters ...string) (*Cgroup2Collector, error) {
+	return newCgroupv2Collector(cgroups, logger, true, filters...)
+}
+
+// NewCgroupv2SubsetCollector is like NewCgroupv2Collector but for a subset of the
+// scraped cgroups. The collectors are created for the single request and not cached.
+func NewCgroupv2SubsetCollector(cgroups []string, logger *slog.Logger, filters ...string) (*Cgroup2Collector, error) {
+	return newCgroupv2Collector(cgroups, logger, false, filters...)
+}
+
+func newCgroupv2Collector(cgroups []string, logger *slog.Logger, cached bool, filters ...string) (*Cgroup2Collector, error) {
 	f := make(map[string]bool)
 	for _, filter := range filters {
 		enabled, exist := collectorState[filter]
 		if !exist {
-			return nil, fmt.Errorf("missing collector: %s", filter)
+			return nil, newFilterError(filter, false)
 		}
 		if !*enabled {
-			return nil, fmt.Errorf("disabled collector: %s", filter)
+			return nil, newFilterError(filter, true)
 		}
 		f[filter] = true
 	}
 	collectors := make(map[string]Collector)
+	var controllers map[string]map[string]bool
+	if *skipDisabledControllers {
+		controllers = readControllers(cgroups, logger)
+	}
 	initiatedCollectorsMtx.Lock()
 	defer initiatedCollectorsMtx.Unlock()
 	for key, enabled := range collectorState {
 		if !*enabled || (len(f) > 0 && !f[key]) {
 			continue
 		}
-		if collector, ok := initiatedCollectors[key]; ok {
+		if collector, ok := initiatedCollectors[key]; ok && cached {
 			collectors[key] = collector
 		} else {
-			collector, err := factories[key](slog.With(logger, "collector", key), cgroups)
+			collector, err := factories[key](logger.With("collector", key), cgroups)
 			if err != nil {
 				return nil, err
 			}
+			if fc, ok := collector.(*Cgroupv2FileCollector); ok {
+				// Subset scrapes only report the requested cgroups.
+				if cached && fc.rootDir != "" {
+					fc.dirNames = withRootCgroup(fc.rootDir, fc.dirNames)
+				}
+				if controllers != nil {
+					fc.dirNames = pruneDisabledControllers(fc.fileName, fc.dirNames, controllers)
+				}
+			}
 			collectors[key] = collector
-			initiatedCollectors[key] = collector
+			if cached {
+				initiatedCollectors[key] = collector
+			}
 		}
 	}
-	return &Cgroup2Collector{Collectors: collectors, logger: logger}, nil
+	return &Cgroup2Collector{Collectors: collectors, logger: logger, subset: !cached}, nil
+}
+
+// FilterError reports a collect[] filter naming a collector that doesn't exist
+// or isn't enabled.
+type FilterError struct {
+	Name     string
+	Disabled bool
+	// Suggestion is the collector closest to a misspelt Name, if any.
+	Suggestion string
+	// Enabled lists the enabled collectors, sorted.
+	Enabled []string
+}
+
+func (e *FilterError) Error() string {
+	if e.Disabled {
+		return fmt.Sprintf("disabled collector: %s, enable it with --collector.%s", e.Name, e.Name)
+	}
+	if e.Suggestion != "" {
+		return fmt.Sprintf("missing collector: %s, did you mean %s?", e.Name, e.Suggestion)
+	}
+	return fmt.Sprintf("missing collector: %s", e.Name)
+}
+
+// maxSuggestionDistance is the largest edit distance between a misspelt
+// collector name and the collector suggested instead.
+const maxSuggestionDistance = 3
+
+func newFilterError(name string, disabled bool) *FilterError {
+	e := &FilterError{Name: name, Disabled: disabled}
+	best := maxSuggestionDistance + 1
+	for collector, enabled := range collectorState {
+		if *enabled {
+			e.Enabled = append(e.Enabled, collector)
+		}
+		if disabled {
+			continue
+		}
+		if d := editDistance(name, collector); d < best || d == best && collector < e.Suggestion {
+			best, e.Suggestion = d, collector
+		}
+	}
+	sort.Strings(e.Enabled)
+	return e
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// controllerForFile returns the controller that provides an interface file, or ""
+// for files which exist regardless of the enabled controllers: the core cgroup.*
+// files, the *.pressure files and cpu.stat.
+func controllerForFile(fileName string) string {
+	if strings.HasSuffix(fileName, ".pressure") || fileName == "cpu.stat" {
+		return ""
+	}
+	controller, _, _ := strings.Cut(fileName, ".")
+	if controller == "cgroup" {
+		return ""
+	}
+	return controller
+}
+
+// readControllers reads cgroup.controllers of every cgroup. Cgroups whose file
+// cannot be read are left out, so that none of their files get pruned.
+func readControllers(cgroups []string, logger *slog.Logger) map[string]map[string]bool {
+	controllers := make(map[string]map[string]bool, len(cgroups))
+	for _, dirName := range cgroups {
+		data, err := os.ReadFile(filepath.Join(dirName, "cgroup.controllers"))
+		if err != nil {
+			logger.Debug("cannot read enabled controllers", "dir", dirName, "err", err)
+			continue
+		}
+		enabled := make(map[string]bool)
+		for _, controller := range strings.Fields(string(data)) {
+			enabled[controller] = true
+		}
+		controllers[dirName] = enabled
+	}
+	return controllers
+}
+
+// pruneDisabledControllers returns the cgroups in which the controller providing
+// fileName is enabled.
+func pruneDisabledControllers(fileName string, dirNames []string, controllers map[string]map[string]bool) []string {
+	controller := controllerForFile(fileName)
+	if controller == "" {
+		return dirNames
+	}
+	pruned := make([]string, 0, len(dirNames))
+	for _, dirName := range dirNames {
+		if enabled, ok := controllers[dirName]; ok && !enabled[controller] {
+			continue
+		}
+		pruned = append(pruned, dirName)
+	}
+	return pruned
+}
+
+// counterSet keeps running totals of counters across scrapes, since every scrape
+// writes into a fresh metrics.Set. It is safe for concurrent use.
+type counterSet struct {
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+func newCounterSet() *counterSet {
+	return &counterSet{values: make(map[string]float64)}
+}
+
+func (cs *counterSet) inc(id string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.values[id]++
+}
+
+func (cs *counterSet) writeTo(metricSet *metrics.Set) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for id, v := range cs.values {
+		metricSet.GetOrCreateFloatCounter(id).Set(v)
+	}
+}
+
+// stallHistogramSet records the increase of PSI stall totals between scrapes.
+// Like counterSet it outlives the per-scrape metrics.Set.
+type stallHistogramSet struct {
+	mtx        sync.Mutex
+	last       map[string]float64 // last total by counter id
+	histograms map[string]*metrics.Histogram
+	// scrape numbers the unfiltered scrapes, and seen holds the scrape the
+	// counter and histogram ids were last observed in and the file they are
+	// from, so that those of vanished cgroups can be evicted.
+	scrape uint64
+	seen   map[string]stallSeen
+}
+
+type stallSeen struct {
+	scrape uint64
+	file   string
+}
+
+func newStallHistogramSet() *stallHistogramSet {
+	return &stallHistogramSet{
+		last:       make(map[string]float64),
+		histograms: make(map[string]*metrics.Histogram),
+		seen:       make(map[string]stallSeen),
+	}
+}
+
+// observe records the increase of the PSI total counterID of file since the
+// previous call. The histogram drops the "_total" suffix and window label of
+// the counter.
+func (hs *stallHistogramSet) observe(file, counterID, metricName string, labels map[string]string, total float64) {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	last, ok := hs.last[counterID]
+	hs.last[counterID] = total
+	hs.seen[counterID] = stallSeen{hs.scrape, file}
+	// Nothing to compare the first total with, and a lower one means the cgroup was recreated.
+	if !ok || total < last {
+		return
+	}
+
+	histogramLabels := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if name != "window" {
+			histogramLabels[name] = value
+		}
+	}
+	id := formatMetricID(joinFQ(strings.TrimSuffix(metricName, "_total")+"_stall_microseconds"), histogramLabels)
+	h, ok := hs.histograms[id]
+	if !ok {
+		h = &metrics.Histogram{}
+		hs.histograms[id] = h
+	}
+	hs.seen[id] = stallSeen{hs.scrape, file}
+	h.Update(total - last)
+}
+
+// begin starts an unfiltered scrape and returns its number for evict.
+func (hs *stallHistogramSet) begin() uint64 {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	hs.scrape++
+	return hs.scrape
+}
+
+// evict drops the totals and histograms of the given files that weren't
+// observed since unfiltered scrape number scrape began, e.g. of removed cgroups.
+func (hs *stallHistogramSet) evict(scrape uint64, files []string) {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	for id, seen := range hs.seen {
+		if seen.scrape < scrape && slices.Contains(files, seen.file) {
+			delete(hs.last, id)
+			delete(hs.histograms, id)
+			delete(hs.seen, id)
+		}
+	}
+}
+
+func (hs *stallHistogramSet) writeTo(metricSet *metrics.Set) {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	for id, h := range hs.histograms {
+		metricSet.GetOrCreateHistogram(id).Merge(h)
+	}
+}
+
+var stallHistograms = newStallHistogramSet()
+
+// skippedCgroups counts cgroups left out of a collection, by reason.
+var skippedCgroups = newCounterSet()
+
+const (
+	skipReasonMissingFile = "missing_file"
+	skipReasonTimeout     = "timeout"
+	skipReasonError       = "error"
+	skipReasonNoPressure  = "pressure_disabled"
+	skipReasonUnsupported = "unsupported"
+	skipReasonUserSlice   = "user_slice_permission"
+)
+
+func countSkipped(reason string) {
+	skippedCgroups.inc(formatMetricID(joinFQ("scrape_cgroups_skipped_total"), map[string]string{"reason": reason}))
 }
 
 // Scrape runs all collectors and writes series into metricSet (typically a fresh Set per HTTP request).
 func (cgc *Cgroup2Collector) Scrape(metricSet *metrics.Set) {
+	b := breakers
+	var stallScrape uint64
+	if cgc.subset {
+		b = nil
+	} else {
+		stallScrape = stallHistograms.begin()
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(len(cgc.Collectors))
 	for name, c := range cgc.Collectors {
 		go func(name string, c Collector) {
 			defer wg.Done()
-			execute(metricSet, name, c, cgc.logger)
+			execute(metricSet, name, c, cgc.logger, b)
 		}(name, c)
 	}
 	wg.Wait()
+	if !cgc.subset {
+		// Only unfiltered scrapes tell which cgroups are gone. Collectors are
+		// named after their file.
+		stallHistograms.evict(stallScrape, slices.Collect(maps.Keys(cgc.Collectors)))
+	}
+	skippedCgroups.writeTo(metricSet)
+	stallHistograms.writeTo(metricSet)
 }
 
+var (
+	unsupportedNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	repeatedUnderscores  = regexp.MustCompile(`_+`)
+)
+
 func sanitizeP8sName(name string) string {
 	// Noticed some cgroup names with escape sequence like \x2d. Clean them up.
 	if unquoted, err := strconv.Unquote(`"` + name + `"`); err == nil {
@@ -141,12 +877,10 @@ func sanitizeP8sName(name string) string {
 	}
 
 	// Use a regular expression to replace unsupported characters with underscores
-	regex := regexp.MustCompile(`[^a-zA-Z0-9_:]`)
-	name = regex.ReplaceAllString(name, "_")
+	name = unsupportedNameChars.ReplaceAllString(name, "_")
 
 	// squeeze underscore repeats
-	regex = regexp.MustCompile(`_+`)
-	name = regex.ReplaceAllString(name, "_")
+	name = repeatedUnderscores.ReplaceAllString(name, "_")
 
 	name = strings.Trim(name, "_")
 
@@ -179,7 +913,16 @@ func escapeLabelValue(s string) string {
 	return b.String()
 }
 
+// formatMetricID returns the metric id with labels sorted by name. Together with
+// metrics.Set sorting series by id, this keeps the exposition byte-stable.
+//
+// The --collector.static-label labels are added unless labels has them.
 func formatMetricID(fqMetricName string, labels map[string]string) string {
+	if len(staticLabels) > 0 {
+		merged := maps.Clone(staticLabels)
+		maps.Copy(merged, labels)
+		labels = merged
+	}
 	if len(labels) == 0 {
 		return fqMetricName
 	}
@@ -213,104 +956,756 @@ func BuildInfoMetric(version, revision, branch, goversion string) string {
 	})
 }
 
-func execute(metricSet *metrics.Set, name string, c Collector, logger *slog.Logger) {
-	begin := time.Now()
-	err := c.Update(metricSet)
-	duration := time.Since(begin)
-	var success float64
+// RuntimeInfo describes the cgroup setup of the host the exporter runs on.
+type RuntimeInfo struct {
+	CgroupMount string // mount point of the cgroup2 hierarchy, empty if there is none
+	Unified     bool   // whether cgroup2 is the only mounted cgroup hierarchy
+	Kernel      string // kernel release
+}
+
+// kernelRelease returns the kernel release. It is a variable so tests can stub it.
+var kernelRelease = func() (string, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", err
+	}
+	b := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b), nil
+}
+
+// ReadRuntimeInfo detects the cgroup mounts from <procfs>/self/mountinfo and the
+// kernel release.
+func ReadRuntimeInfo(procfs string) (RuntimeInfo, error) {
+	var info RuntimeInfo
+	data, err := os.ReadFile(filepath.Join(procfs, "self", "mountinfo"))
+	if err != nil {
+		return info, err
+	}
+	v1 := false
+	for line := range strings.Lines(string(data)) {
+		// The filesystem type follows the "-" separating the optional fields.
+		fields := strings.Fields(line)
+		sep := slices.Index(fields, "-")
+		if sep < 4 || sep+1 >= len(fields) {
+			continue
+		}
+		switch fields[sep+1] {
+		case "cgroup2":
+			if info.CgroupMount == "" {
+				info.CgroupMount = fields[4]
+			}
+		case "cgroup":
+			v1 = true
+		}
+	}
+	info.Unified = info.CgroupMount != "" && !v1
+	info.Kernel, err = kernelRelease()
+	return info, err
+}
+
+// RuntimeInfoMetric returns the metric id for cgroupv2_exporter_runtime_info with the labels of info.
+func RuntimeInfoMetric(info RuntimeInfo) string {
+	return formatMetricID(joinFQ("exporter_runtime_info"), map[string]string{
+		"cgroup_mount": info.CgroupMount,
+		"unified":      strconv.FormatBool(info.Unified),
+		"kernel":       info.Kernel,
+	})
+}
+
+// Metric ids of the exporter's scrape concurrency, bounded by --web.max-requests.
+const (
+	ScrapesInFlightMetric = namespace + "_exporter_scrapes_in_flight"
+	ScrapesRejectedMetric = namespace + "_exporter_scrapes_rejected_total"
+)
+
+// CgroupfsMountedMetric is the metric id of cgroupv2_cgroupfs_mounted, telling
+// whether a cgroup filesystem is mounted at --path.cgroupfs.
+const CgroupfsMountedMetric = namespace + "_cgroupfs_mounted"
+
+// AvailableMetric returns the metric id for cgroupv2_collector_available of the given collector.
+func AvailableMetric(collector string) string {
+	return formatMetricID(joinFQ("collector_available"), map[string]string{"collector": collector})
+}
+
+// WriteFDMetrics sets cgroupv2_exporter_open_fds and cgroupv2_exporter_max_fds to
+// the exporter's open file descriptors and their soft limit, so that running out
+// can be alerted on even with the process metrics disabled.
+func WriteFDMetrics(metricSet *metrics.Set) error {
+	fds, err := countOpenFDs()
+	if err != nil {
+		return err
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return err
+	}
+	metricSet.GetOrCreateGauge(joinFQ("exporter_open_fds"), nil).Set(float64(fds))
+	metricSet.GetOrCreateGauge(joinFQ("exporter_max_fds"), nil).Set(float64(limit.Cur))
+	return nil
+}
+
+// countOpenFDs counts the open file descriptors of the process, leaving out the
+// one of /proc/self/fd itself while it is listed.
+func countOpenFDs() (int, error) {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	own := strconv.Itoa(int(dir.Fd()))
+	count := 0
+	for _, name := range names {
+		if name != own {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// availabilityChecker is implemented by the collectors, telling whether they
+// can collect anything from cgroup.
+type availabilityChecker interface {
+	// checkAvailable returns the error reading what the collector needs from
+	// cgroup, fs.ErrNotExist if it is missing.
+	checkAvailable(cgroup string) error
+}
+
+// CheckAvailability checks every enabled collector against cgroup, e.g. by
+// reading its file, and logs whether it is usable, so that missing controllers
+// are visible at startup instead of showing up as empty dashboards. The
+// returned map is keyed by collector name.
+func CheckAvailability(cgroup string, logger *slog.Logger) map[string]bool {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		if *collectorState[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	available := make(map[string]bool, len(names))
+	for _, name := range names {
+		c, err := factories[name](logger.With("collector", name), []string{cgroup})
+		if err != nil {
+			logger.Error("couldn't create collector for availability check", "name", name, "err", err)
+			available[name] = false
+			continue
+		}
+		checker, ok := c.(availabilityChecker)
+		if !ok {
+			logger.Warn("collector availability unknown", "collector", name)
+			continue
+		}
+
+		status := "ok"
+		if err := checker.checkAvailable(cgroup); err != nil {
+			status = "unreadable"
+			if errors.Is(err, fs.ErrNotExist) {
+				status = "missing"
+			}
+			logger.Debug("collector not usable", "collector", name, "cgroup", cgroup, "err", err)
+		}
+		available[name] = status == "ok"
+		logger.Info("collector availability", "collector", name, "status", status)
+	}
+	return available
+}
+
+func (cc *Cgroupv2FileCollector) checkAvailable(cgroup string) error {
+	if cc.rootDir != "" && cc.cgroupFilter != nil && !cc.cgroupFilter(cgroup) {
+		// The file only exists in the root cgroup.
+		cgroup = cc.rootDir
+	}
+	return readAll(filepath.Join(cgroup, cc.fileName))
+}
+
+func readAll(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(io.Discard, file)
+	return err
+}
+
+// update runs c.Update, turning a panic into an error. metrics.Set panics when a
+// series is requested with a different type than it was created with, which is
+// the closest thing to a descriptor consistency check this exporter has; it must
+// fail the collector, not the whole process.
+func update(metricSet *metrics.Set, c Collector) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("collector panicked: %v", r)
+		}
+	}()
+	return c.Update(metricSet)
+}
+
+// clock is the source of time for the scrape duration metrics, replaceable in tests.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var scrapeClock clock = realClock{}
+
+// execute runs collector name and writes its scrape metrics. b, if not nil,
+// is the set of circuit breakers the run is subject to and counted in.
+func execute(metricSet *metrics.Set, name string, c Collector, logger *slog.Logger, b *breakerSet) {
+	begin := scrapeClock.Now()
+	if !b.allow(metricSet, name, begin) {
+		// Keep reporting the failure, so that alerts on it keep firing.
+		logger.Debug("collector circuit open, skipping", "name", name)
+		writeScrapeMetrics(metricSet, name, 0, false)
+		markSuccess(metricSet, name, false, begin)
+		return
+	}
+	err := update(metricSet, c)
+	duration := scrapeClock.Now().Sub(begin)
 
 	if err != nil {
 		if IsNoDataError(err) {
 			logger.Debug("collector returned no data", "name", name, "duration_seconds", duration.Seconds(), "err", err)
+		} else if errorType(err) == "permission" {
+			logger.Warn("collector failed", "name", name, "duration_seconds", duration.Seconds(), "err", err)
 		} else {
 			logger.Error("collector failed", "name", name, "duration_seconds", duration.Seconds(), "err", err)
 		}
-		success = 0
 	} else {
 		logger.Debug("collector succeeded", "name", name, "duration_seconds", duration.Seconds())
+	}
+	writeScrapeMetrics(metricSet, name, duration, err == nil)
+	countErrors(metricSet, name, err)
+	markSuccess(metricSet, name, err == nil, begin)
+	b.record(metricSet, name, err != nil, begin, logger)
+}
+
+// writeScrapeMetrics writes the duration and success of a run of collector name.
+func writeScrapeMetrics(metricSet *metrics.Set, name string, duration time.Duration, ok bool) {
+	success := 0.0
+	if ok {
 		success = 1
 	}
-	durID := formatMetricID(joinFQ("scrape_collector_duration_seconds"), map[string]string{"collector": name})
-	metricSet.GetOrCreateGauge(durID, nil).Set(duration.Seconds())
-	okID := formatMetricID(joinFQ("scrape_collector_success"), map[string]string{"collector": name})
-	metricSet.GetOrCreateGauge(okID, nil).Set(success)
+	if *compactScrapeMetrics {
+		durID := formatMetricID(joinFQ("scrape_collector_duration_seconds"), map[string]string{"collector": name, "success": strconv.FormatBool(ok)})
+		metricSet.GetOrCreateGauge(durID, nil).Set(duration.Seconds())
+	} else {
+		durID := formatMetricID(joinFQ("scrape_collector_duration_seconds"), map[string]string{"collector": name})
+		metricSet.GetOrCreateGauge(durID, nil).Set(duration.Seconds())
+		okID := formatMetricID(joinFQ("scrape_collector_success"), map[string]string{"collector": name})
+		metricSet.GetOrCreateGauge(okID, nil).Set(success)
+	}
+}
+
+// openFile opens a cgroup interface file for reading. Interface files are never
+// symlinks, so refuse to follow one out of the cgroup.
+var openFile = func(name string) (io.ReadCloser, error) {
+	return os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
+
+// markDenied records that the file of dirName is not readable and reports
+// whether that is new.
+func (cc *Cgroupv2FileCollector) markDenied(dirName string) bool {
+	cc.deniedMtx.Lock()
+	defer cc.deniedMtx.Unlock()
+	if cc.denied[dirName] {
+		return false
+	}
+	if cc.denied == nil {
+		cc.denied = make(map[string]bool)
+	}
+	cc.denied[dirName] = true
+	return true
+}
+
+// clearDenied forgets a denied file once it has been read, so that losing the
+// permission again is reported again.
+func (cc *Cgroupv2FileCollector) clearDenied(dirName string) {
+	cc.deniedMtx.Lock()
+	defer cc.deniedMtx.Unlock()
+	delete(cc.denied, dirName)
 }
 
 func (cc *Cgroupv2FileCollector) Update(metricSet *metrics.Set) error {
+	var errs []error
+	found, pressureDisabled, unsupported := false, false, false
 	for _, dirName := range cc.dirNames {
+		baseLabels := cgroupBaseLabels(dirName)
+		if cc.rootDir != "" && filepath.Clean(dirName) == cc.rootDir {
+			baseLabels["cgroup"] = rootCgroupLabel
+		}
+		cgroupName := baseLabels["cgroup"]
+		if cc.cgroupFilter != nil && !cc.cgroupFilter(dirName) {
+			continue
+		}
+		if cc.pressureEnabled != nil && !cc.pressureEnabled(dirName) {
+			// The file still reads as all zeros, which would pass for no stalls.
+			cc.logger.Debug("PSI accounting disabled, skipping cgroup", "dir", dirName)
+			pressureDisabled = true
+			countSkipped(skipReasonNoPressure)
+			continue
+		}
 		filePath := filepath.Join(dirName, cc.fileName)
-		file, err := os.Open(filePath)
+		metricsFromFile, err := cc.readFile(filePath)
 		if err != nil {
-			if os.IsNotExist(err) {
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				if cc.zeroFill && *zeroFill {
+					cc.logger.Debug("file not found, emitting zero", "file", cc.fileName, "dir", dirName)
+					labels := map[string]string{"cgroup": cgroupName}
+					if unit := metricUnit(cc.fileName, nil); *unitLabel && unit != "" {
+						labels["unit"] = unit
+					}
+					id := formatMetricID(joinFQ(sanitizeP8sName(cc.fileName)), labels)
+					metricSet.GetOrCreateGauge(id, nil).Set(0)
+					found = true
+					continue
+				}
 				cc.logger.Debug("file not found, skipping", "file", cc.fileName, "dir", dirName)
-				continue
+				countSkipped(skipReasonMissingFile)
+			case errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENODEV):
+				// The file exists but its controller isn't functional here.
+				cc.logger.Debug("reading file not supported, skipping cgroup", "dir", dirName, "err", err)
+				unsupported = true
+				countSkipped(skipReasonUnsupported)
+			case errors.Is(err, errFileTimeout):
+				found = true
+				cc.logger.Warn("reading file timed out, skipping cgroup", "dir", dirName, "timeout", *fileTimeout)
+				countSkipped(skipReasonTimeout)
+			case errors.Is(err, fs.ErrPermission):
+				found = true
+				id := formatMetricID(joinFQ("collector_permission_denied"), map[string]string{"collector": cc.fileName, "cgroup": cgroupName})
+				metricSet.GetOrCreateGauge(id, nil).Set(1)
+				if inUserSlice(dirName) {
+					// Expected when not running as the user owning the slice.
+					if cc.markDenied(dirName) {
+						cc.logger.Info("permission denied in user.slice, skipping cgroup; use --no-collector.user-slices to exclude user slices", "dir", dirName, "err", err)
+					}
+					countSkipped(skipReasonUserSlice)
+					continue
+				}
+				if cc.markDenied(dirName) {
+					cc.logger.Warn("permission denied, skipping cgroup until the file becomes readable", "dir", dirName, "err", err)
+					errs = append(errs, fmt.Errorf("%w: %w", ErrPermission, err))
+				} else {
+					cc.logger.Debug("permission still denied", "dir", dirName)
+				}
+				countSkipped(skipReasonError)
+			default:
+				found = true
+				if *rawOnParseFailure && errors.Is(err, ErrParse) {
+					id := formatMetricID(joinFQ("raw_file"), map[string]string{"file": cc.fileName, "cgroup": cgroupName})
+					metricSet.GetOrCreateGauge(id, nil).Set(1)
+				}
+				cc.logger.Debug("failed to read file", "dir", dirName, "err", err)
+				errs = append(errs, err)
+				countSkipped(skipReasonError)
 			}
-			cc.logger.Error("failed to open file", "dir", dirName, "err", err)
 			continue
 		}
-		func() {
-			defer file.Close()
-			metricsFromFile, err := cc.parser.Parse(file)
-			if err != nil {
-				cc.logger.Error("failed to parse file", "dir", dirName, "err", err)
-				return
-			}
+		found = true
+		cc.clearDenied(dirName)
+		if cc.cgroupLabels != nil {
+			maps.Copy(baseLabels, cc.cgroupLabels(dirName))
+		}
+		if cc.extraMetrics != nil {
+			// Clip, so that appending never writes to a cached read.
+			metricsFromFile = append(slices.Clip(metricsFromFile), cc.extraMetrics(metricsFromFile)...)
+		}
 
-			cgroupName := sanitizeP8sName(filepath.Base(dirName))
-			for _, metric := range metricsFromFile {
-				metricName := sanitizeP8sName(metric.Name)
+		for _, metric := range metricsFromFile {
+			metricName := sanitizeP8sName(metric.Name)
+			if math.IsNaN(metric.Value) {
+				cc.logger.Warn("skipping NaN metric value", "name", metricName, "labels", metric.Labels, "cgroup", cgroupName)
+				continue
+			}
+			if *dropNonFinite && math.IsInf(metric.Value, 0) {
+				cc.logger.Debug("dropping non-finite metric", "name", metricName, "value", metric.Value, "cgroup", cgroupName)
+				continue
+			}
 
-				labels := make(map[string]string, 1+len(metric.Labels))
-				labels["cgroup"] = cgroupName
-				for labelName, labelValue := range metric.Labels {
-					labels[labelName] = labelValue
+			labels := make(map[string]string, len(baseLabels)+len(metric.Labels))
+			maps.Copy(labels, metric.Labels)
+			maps.Copy(labels, baseLabels)
+			if *unitLabel {
+				if unit := metricUnit(cc.fileName, metric.Labels); unit != "" {
+					labels["unit"] = unit
 				}
+			}
 
-				id := formatMetricID(joinFQ(metricName), labels)
-				if cc.isCounter(metricName, metric.Labels) {
-					metricSet.GetOrCreateFloatCounter(id).Set(metric.Value)
-				} else {
-					metricSet.GetOrCreateGauge(id, nil).Set(metric.Value)
+			id := formatMetricID(joinFQ(metricName), labels)
+			isCounter := cc.isCounter(metricName, metric.Labels)
+			if counter, ok := overrideIsCounter(joinFQ(metricName)); ok {
+				isCounter = counter
+			}
+			if isCounter {
+				metricSet.GetOrCreateFloatCounter(id).Set(metric.Value)
+				if cc.stallHistogram && *psiHistogram {
+					stallHistograms.observe(cc.fileName, id, metricName, labels, metric.Value)
 				}
-				cc.logger.Debug("collected metric", "name", metricName, "value", metric.Value, "labels", metric.Labels, "cgroup", cgroupName)
+			} else {
+				metricSet.GetOrCreateGauge(id, nil).Set(metric.Value)
 			}
-		}()
+			cc.logger.Debug("collected metric", "name", metricName, "value", metric.Value, "labels", metric.Labels, "cgroup", cgroupName)
+		}
 	}
 
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if !found && pressureDisabled {
+		return ErrPressureDisabled
+	}
+	if !found && unsupported {
+		return ErrUnsupported
+	}
+	// The file doesn't exist in any cgroup, e.g. on kernels that predate it.
+	if !found {
+		return ErrFileMissing
+	}
 	return nil
 }
 
+// errFileTimeout is returned by readFile when --collector.file-timeout expires.
+var errFileTimeout = errors.New("timed out reading file")
+
+// cachedRead is the result of reading and parsing a file at a point in time.
+type cachedRead struct {
+	metrics []parsers.Metric
+	err     error
+	at      time.Time
+}
+
+// readFile reads and parses filePath, or returns the result of a read less than
+// --collector.cache-ttl ago. Concurrent misses for the same path share a single
+// read. The returned metrics must not be modified.
+func (cc *Cgroupv2FileCollector) readFile(filePath string) ([]parsers.Metric, error) {
+	if *cacheTTL <= 0 {
+		return cc.readFileWithTimeout(filePath)
+	}
+	now := scrapeClock.Now()
+	cc.readsMtx.Lock()
+	r, ok := cc.reads[filePath]
+	cc.readsMtx.Unlock()
+	if ok && now.Sub(r.at) < *cacheTTL {
+		return r.metrics, r.err
+	}
+
+	v, err, _ := cc.readGroup.Do(filePath, func() (any, error) {
+		metricsFromFile, err := cc.readFileWithTimeout(filePath)
+		if !errors.Is(err, errFileTimeout) {
+			cc.storeRead(filePath, cachedRead{metrics: metricsFromFile, err: err, at: now})
+		}
+		return metricsFromFile, err
+	})
+	metricsFromFile, _ := v.([]parsers.Metric)
+	return metricsFromFile, err
+}
+
+// storeRead caches r for filePath. Once per --collector.cache-ttl it drops the
+// expired reads, e.g. of removed cgroups, so that the cache doesn't grow with
+// every cgroup ever read.
+func (cc *Cgroupv2FileCollector) storeRead(filePath string, r cachedRead) {
+	cc.readsMtx.Lock()
+	defer cc.readsMtx.Unlock()
+	if cc.reads == nil {
+		cc.reads = make(map[string]cachedRead)
+	}
+	if r.at.Sub(cc.prunedAt) >= *cacheTTL {
+		maps.DeleteFunc(cc.reads, func(_ string, cached cachedRead) bool {
+			return r.at.Sub(cached.at) >= *cacheTTL
+		})
+		cc.prunedAt = r.at
+	}
+	cc.reads[filePath] = r
+}
+
+// readFileWithTimeout reads and parses filePath. With --collector.file-timeout
+// set, a read hanging longer than the timeout is abandoned so that the remaining
+// cgroups can still be collected; the blocked goroutine finishes whenever the
+// read returns.
+func (cc *Cgroupv2FileCollector) readFileWithTimeout(filePath string) ([]parsers.Metric, error) {
+	if *fileTimeout <= 0 {
+		return cc.parseFile(filePath)
+	}
+
+	type result struct {
+		metrics []parsers.Metric
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		metricsFromFile, err := cc.parseFile(filePath)
+		done <- result{metricsFromFile, err}
+	}()
+
+	timer := time.NewTimer(*fileTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.metrics, r.err
+	case <-timer.C:
+		return nil, errFileTimeout
+	}
+}
+
+func (cc *Cgroupv2FileCollector) parseFile(filePath string) ([]parsers.Metric, error) {
+	file, err := openFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if _, streaming := cc.parser.(*parsers.LineCountParser); !streaming && *maxFileSize > 0 {
+		reader, err = cc.capFile(filePath, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metricsFromFile, err := cc.parser.Parse(reader)
+	if errors.Is(err, parsers.ErrMalformed) {
+		return nil, fmt.Errorf("%w %s: %w", ErrParse, filePath, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filePath, err)
+	}
+	return metricsFromFile, nil
+}
+
+// capFile reads at most --collector.max-file-size bytes of file. If it is
+// larger, the content is cut after the last complete line within the limit.
+func (cc *Cgroupv2FileCollector) capFile(filePath string, file io.Reader) (io.Reader, error) {
+	limit := int64(*maxFileSize)
+	content, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		content = content[:limit]
+		if i := bytes.LastIndexByte(content, '\n'); i >= 0 {
+			content = content[:i+1]
+		} else {
+			content = content[:0]
+		}
+		cc.logger.Warn("file exceeds maximum size, truncating", "path", filePath, "max_size", *maxFileSize)
+	}
+	return bytes.NewReader(content), nil
+}
+
 // Collector is the interface a collector has to implement.
 type Collector interface {
 	Update(metricSet *metrics.Set) error
 }
 
-// ErrNoData indicates the collector found no data to collect, but had no other error.
-var ErrNoData = errors.New("collector returned no data")
+var (
+	// ErrNoData indicates the collector found no data to collect, but had no other error.
+	ErrNoData = errors.New("collector returned no data")
+	// ErrFileMissing indicates the collector's file exists in none of the cgroups.
+	// It wraps ErrNoData.
+	ErrFileMissing = fmt.Errorf("%w: file missing", ErrNoData)
+	// ErrPressureDisabled indicates PSI accounting is disabled in all cgroups
+	// of a pressure collector. It wraps ErrNoData.
+	ErrPressureDisabled = fmt.Errorf("%w: PSI accounting disabled", ErrNoData)
+	// ErrUnsupported indicates the collector's file exists but reading it fails
+	// with EOPNOTSUPP or ENODEV in all cgroups. It wraps ErrNoData.
+	ErrUnsupported = fmt.Errorf("%w: file not supported", ErrNoData)
+	// ErrParse indicates a file was read but its content couldn't be parsed,
+	// see parsers.ErrMalformed.
+	ErrParse = errors.New("failed to parse")
+	// ErrPermission indicates a file couldn't be opened due to missing permissions.
+	ErrPermission = errors.New("permission denied")
+)
 
 func IsNoDataError(err error) bool {
-	return err == ErrNoData
+	return errors.Is(err, ErrNoData)
+}
+
+// errorType classifies err for the scrape_collector_errors_total metric.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, ErrPermission):
+		return "permission"
+	case errors.Is(err, ErrParse):
+		return "parse"
+	default:
+		return "other"
+	}
+}
+
+// collectorErrors counts the errors of every collector by type. It outlives the
+// per-scrape metric Set, so the counts are kept here.
+var collectorErrors = struct {
+	sync.Mutex
+	counts map[string]map[string]float64
+}{counts: make(map[string]map[string]float64)}
+
+// countErrors adds the errors joined in err to the counters of collector name and
+// writes them to metricSet.
+func countErrors(metricSet *metrics.Set, name string, err error) {
+	collectorErrors.Lock()
+	defer collectorErrors.Unlock()
+	counts, ok := collectorErrors.counts[name]
+	if !ok {
+		counts = make(map[string]float64)
+		collectorErrors.counts[name] = counts
+	}
+	if err != nil && !IsNoDataError(err) {
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+		for _, e := range errs {
+			counts[errorType(e)]++
+		}
+	}
+	for typ, count := range counts {
+		id := formatMetricID(joinFQ("scrape_collector_errors_total"), map[string]string{"collector": name, "type": typ})
+		metricSet.GetOrCreateFloatCounter(id).Set(count)
+	}
+}
+
+// lastSuccess keeps the time every collector last succeeded, as it outlives
+// the per-scrape metric Set like collectorErrors.
+var lastSuccess = struct {
+	sync.Mutex
+	times map[string]time.Time
+}{times: make(map[string]time.Time)}
+
+// markSuccess records begin as the last success of collector name if ok and
+// writes the last success, if any, to metricSet.
+func markSuccess(metricSet *metrics.Set, name string, ok bool, begin time.Time) {
+	lastSuccess.Lock()
+	defer lastSuccess.Unlock()
+	if ok {
+		lastSuccess.times[name] = begin
+	}
+	if t, found := lastSuccess.times[name]; found {
+		id := formatMetricID(joinFQ("collector_last_success_timestamp_seconds"), map[string]string{"collector": name})
+		metricSet.GetOrCreateGauge(id, nil).Set(float64(t.UnixNano()) / 1e9)
+	}
+}
+
+// breakerSet is the circuit breaker of --collector.breaker-failures. It stops
+// running collectors that failed that many scrapes in a row, e.g. for a file
+// that exists nowhere, and retries them every --collector.breaker-retry-interval.
+type breakerSet struct {
+	sync.Mutex
+	failures  map[string]int       // consecutive failures by collector
+	openUntil map[string]time.Time // next retry of collectors with an open circuit
+}
+
+var breakers = &breakerSet{failures: make(map[string]int), openUntil: make(map[string]time.Time)}
+
+// allow reports whether collector name may run at now, writing
+// cgroupv2_collector_circuit_open for it if it doesn't. A nil b allows all.
+func (b *breakerSet) allow(metricSet *metrics.Set, name string, now time.Time) bool {
+	if b == nil || *breakerFailures <= 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if until, open := b.openUntil[name]; open && now.Before(until) {
+		metricSet.GetOrCreateGauge(circuitOpenMetric(name), nil).Set(1)
+		return false
+	}
+	return true
+}
+
+// record counts a run of collector name and opens its circuit after
+// --collector.breaker-failures consecutive failures. A success closes it.
+func (b *breakerSet) record(metricSet *metrics.Set, name string, failed bool, now time.Time, logger *slog.Logger) {
+	if b == nil || *breakerFailures <= 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	open := 0.0
+	switch {
+	case !failed:
+		delete(b.failures, name)
+		delete(b.openUntil, name)
+	case b.failures[name]+1 >= *breakerFailures:
+		b.failures[name]++
+		if _, reopened := b.openUntil[name]; !reopened {
+			logger.Warn("collector keeps failing, pausing it", "name", name, "failures", b.failures[name], "retry_interval", *breakerRetryInterval)
+		}
+		b.openUntil[name] = now.Add(*breakerRetryInterval)
+		open = 1
+	default:
+		b.failures[name]++
+	}
+	metricSet.GetOrCreateGauge(circuitOpenMetric(name), nil).Set(open)
+}
+
+func circuitOpenMetric(name string) string {
+	return formatMetricID(joinFQ("collector_circuit_open"), map[string]string{"collector": name})
 }
 
 func init() {
 	registerCollector("memory.pressure", defaultEnabled, NewMemoryPressureCollector)
 	registerCollector("memory.current", defaultEnabled, NewMemoryCurrentCollector)
 	registerCollector("memory.swap.current", defaultEnabled, NewMemorySwapCurrentCollector)
+	registerCollector("memory.swap.peak", defaultEnabled, NewMemorySwapPeakCollector)
+	registerCollector("memory.zswap.current", defaultEnabled, NewMemoryZswapCurrentCollector)
+	registerCollector("memory.zswap.max", defaultEnabled, NewMemoryZswapMaxCollector)
+	registerCollector("memory.zswap.writeback", defaultEnabled, NewMemoryZswapWritebackCollector)
 	registerCollector("memory.high", defaultEnabled, NewMemoryHighCollector)
+	registerCollector("memory.peak", defaultEnabled, NewMemoryPeakCollector)
 	registerCollector("memory.stat", defaultDisabled, NewMemoryStatCollector)
+	registerCollector("memory.utilization", defaultEnabled, NewMemoryUtilizationCollector)
+	registerCollector("memory.over_high", defaultEnabled, NewMemoryOverHighCollector)
+	registerCollector("memory.sock", defaultDisabled, NewMemorySockCollector)
 	registerCollector("cpu.pressure", defaultEnabled, NewCpuPressureCollector)
+	registerCollector("irq.pressure", defaultDisabled, NewIrqPressureCollector)
 	registerCollector("cpuset.cpus", defaultEnabled, NewCPUSetCpusCollector)
 	registerCollector("cpuset.cpus.effective", defaultEnabled, NewCPUSetCpusEffectiveCollector)
 	registerCollector("cpu.stat", defaultEnabled, NewCpuStatCollector)
+	registerCollector("cpu.stat.local", defaultEnabled, NewCpuStatLocalCollector)
+	registerCollector("cpu.idle", defaultEnabled, NewCpuIdleCollector)
 	registerCollector("cpuset.mems", defaultEnabled, NewCPUSetMemsCollector)
+	registerCollector("cpuset.cpus.partition", defaultEnabled, NewCPUSetPartitionCollector)
 	registerCollector("cpuset.mems.effective", defaultEnabled, NewCPUSetMemsEffectiveCollector)
 	registerCollector("io.pressure", defaultEnabled, NewIoPressureCollector)
 	registerCollector("io.stat", defaultEnabled, NewIoStatCollector)
+	registerCollector("io.cost.qos", defaultDisabled, NewIoCostQosCollector)
+	registerCollector("io.cost.model", defaultDisabled, NewIoCostModelCollector)
 	registerCollector("pids.current", defaultEnabled, NewPidsCurrentCollector)
 	registerCollector("pids.peak", defaultEnabled, NewPidsPeakCollector)
+	registerCollector("pids.events", defaultEnabled, NewPidsEventsCollector)
+	registerCollector("pids.events.local", defaultEnabled, NewPidsEventsLocalCollector)
+	registerCollector("cgroup.max.descendants", defaultEnabled, NewCgroupMaxDescendantsCollector)
+	registerCollector("cgroup.max.depth", defaultEnabled, NewCgroupMaxDepthCollector)
+	registerCollector("cgroup.is_leaf", defaultEnabled, NewCgroupIsLeafCollector)
+	registerCollector("cgroup.pressure", defaultEnabled, NewCgroupPressureCollector)
+	registerCollector("cgroup.stat", defaultEnabled, NewCgroupStatCollector)
+	registerCollector("cgroup.procs", defaultEnabled, NewCgroupProcsCollector)
+	registerCollector("cgroup.threads", defaultEnabled, NewCgroupThreadsCollector)
+	registerCollector("cgroup.depth", defaultDisabled, NewCgroupDepthCollector)
+	registerCollector("node.pressure", defaultDisabled, NewNodePressureCollector)
 }
 
 const (
 	defaultEnabled  = true
 	defaultDisabled = false
 )
+
+// Values of --collector.psi-layout and --collector.memory-stat-layout.
+const (
+	layoutLabel = "label" // cgroupv2_memory_pressure_avg10{type="some"}, cgroupv2_memory_stat{stat="anon"}
+	layoutName  = "name"  // cgroupv2_memory_pressure_some_avg10, cgroupv2_memory_stat_anon
+)
@@ -0,0 +1,2867 @@
+package collector
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/asama-ai/cgroupv2_exporter/parsers"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+)
+
+var logger = promslog.New(&promslog.Config{})
+
+// writeCgroup creates a fake cgroup directory named name under root and
+// populates it with the given interface files.
+func writeCgroup(t *testing.T, root, name string, files map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("Error creating cgroup dir: %v", err)
+	}
+	for file, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644); err != nil {
+			t.Fatalf("Error writing %s: %v", file, err)
+		}
+	}
+	return dir
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files of TestGoldenOutput")
+
+// scrape runs a single Update of c and returns the exposition text.
+func scrape(c Collector) (string, error) {
+	ms := metrics.NewSet()
+	err := c.Update(ms)
+	var b bytes.Buffer
+	ms.WritePrometheus(&b)
+	return b.String(), err
+}
+
+func TestDropNonFinite(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "limited", map[string]string{"memory.high": "1024"}),
+		writeCgroup(t, root, "unlimited", map[string]string{"memory.high": "max"}),
+	}
+
+	c, err := NewMemoryHighCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_high{cgroup="unlimited"} +Inf`) {
+		t.Errorf("Expected +Inf series without --web.drop-inf, got:\n%s", out)
+	}
+
+	*dropNonFinite = true
+	defer func() { *dropNonFinite = false }()
+
+	out, err = scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if strings.Contains(out, `cgroup="unlimited"`) {
+		t.Errorf("Expected +Inf series to be dropped, got:\n%s", out)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_high{cgroup="limited"} 1024`) {
+		t.Errorf("Expected finite series to be kept, got:\n%s", out)
+	}
+}
+
+// staticParser returns a fixed set of metrics regardless of the file content.
+type staticParser struct {
+	metrics []parsers.Metric
+}
+
+func (p *staticParser) Parse(io.Reader) ([]parsers.Metric, error) {
+	return p.metrics, nil
+}
+
+func TestSkipNaN(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "nan", map[string]string{"derived": ""})}
+
+	var logs bytes.Buffer
+	c := &Cgroupv2FileCollector{
+		parser: &staticParser{metrics: []parsers.Metric{
+			{Name: "derived_ratio", Value: math.NaN(), Labels: map[string]string{}},
+			{Name: "derived_count", Value: 3, Labels: map[string]string{}},
+		}},
+		dirNames:  cgroups,
+		fileName:  "derived",
+		logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+		isCounter: func(string, map[string]string) bool { return false },
+	}
+
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if strings.Contains(out, "derived_ratio") {
+		t.Errorf("Expected NaN series to be skipped, got:\n%s", out)
+	}
+	if !strings.Contains(out, `cgroupv2_derived_count{cgroup="nan"} 3`) {
+		t.Errorf("Expected finite series to be kept, got:\n%s", out)
+	}
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "derived_ratio") {
+		t.Errorf("Expected a warning naming the NaN metric, got:\n%s", logs.String())
+	}
+}
+
+func TestPidsEventsCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app.service", map[string]string{"pids.events": "max 7\n"})}
+
+	c, err := NewPidsEventsCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ms := metrics.NewSet()
+	if err := c.Update(ms); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+
+	id := `cgroupv2_pids_events{cgroup="app_service",stat="max"}`
+	names := ms.ListMetricNames()
+	if len(names) != 1 || names[0] != id {
+		t.Fatalf("Expected only %s, got %v", id, names)
+	}
+	// GetOrCreateFloatCounter panics if the series was registered as a gauge.
+	if v := ms.GetOrCreateFloatCounter(id).Get(); v != 7 {
+		t.Errorf("Expected max counter 7, got %f", v)
+	}
+}
+
+func TestCgroupStatCollector(t *testing.T) {
+	root := writeCgroup(t, t.TempDir(), "cgroup", map[string]string{"cgroup.stat": "nr_descendants 120\nnr_dying_descendants 7\n"})
+	app := writeCgroup(t, root, "app.slice", map[string]string{"cgroup.stat": "nr_descendants 2\nnr_dying_descendants 0\n"})
+	defer func(orig string) { rootCgroup = orig }(rootCgroup)
+	SetRootCgroup(root)
+
+	defer delete(initiatedCollectors, "cgroup.stat")
+
+	for _, cgroups := range [][]string{{app}, {root + "/", app}} {
+		delete(initiatedCollectors, "cgroup.stat")
+		cgc, err := NewCgroupv2Collector(cgroups, logger, "cgroup.stat")
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(cgc.Collectors["cgroup.stat"])
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		if n := strings.Count(out, `stat="nr_descendants"`); n != 2 {
+			t.Errorf("Expected the root cgroup once for cgroups %v, got:\n%s", cgroups, out)
+		}
+		for _, expected := range []string{
+			`cgroupv2_cgroup_stat{cgroup="root",stat="nr_descendants"} 120`,
+			`cgroupv2_cgroup_stat{cgroup="root",stat="nr_dying_descendants"} 7`,
+			`cgroupv2_cgroup_stat{cgroup="app_slice",stat="nr_descendants"} 2`,
+		} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %s for cgroups %v, got:\n%s", expected, cgroups, out)
+			}
+		}
+		if strings.Contains(out, `cgroup="cgroup"`) {
+			t.Errorf("Expected the root cgroup only labelled root, got:\n%s", out)
+		}
+	}
+
+	// A ?cgroup= scrape must not add the root cgroup.
+	cgc, err := NewCgroupv2SubsetCollector([]string{app}, logger, "cgroup.stat")
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(cgc.Collectors["cgroup.stat"])
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if strings.Contains(out, `cgroup="root"`) {
+		t.Errorf("Expected no root cgroup in a subset scrape, got:\n%s", out)
+	}
+}
+
+func TestCpuStatThreaded(t *testing.T) {
+	root := t.TempDir()
+	domain := writeCgroup(t, root, "app.service", map[string]string{"cgroup.type": "domain threaded\n", "cpu.stat": "usage_usec 300\n"})
+	workers := writeCgroup(t, domain, "workers", map[string]string{"cgroup.type": "threaded\n", "cpu.stat": "usage_usec 200\n"})
+	other := writeCgroup(t, root, "other.service", map[string]string{"cgroup.type": "domain\n", "cpu.stat": "usage_usec 100\n"})
+
+	c, err := NewCpuStatCollector(logger, []string{domain, workers, other})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cpu_stat{cgroup="app_service",stat="usage_usec"} 300`,
+		`cgroupv2_cpu_stat{cgroup="workers",stat="usage_usec",threaded="true"} 200`,
+		`cgroupv2_cpu_stat{cgroup="other_service",stat="usage_usec"} 100`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	// cgroup.type is read like the collector's own file, sharing the cache.
+	*cacheTTL = time.Minute
+	defer func() { *cacheTTL = 0 }()
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	opens := 0
+	openFile = func(name string) (io.ReadCloser, error) {
+		if filepath.Base(name) == "cgroup.type" {
+			opens++
+		}
+		return os.Open(name)
+	}
+	c, err = NewCpuStatCollector(logger, []string{domain, workers, other})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	for range 2 {
+		if _, err := scrape(c); err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+	}
+	if opens != 3 {
+		t.Errorf("Expected cgroup.type to be read once per cgroup within --collector.cache-ttl, got %d reads", opens)
+	}
+}
+
+func TestNodePressureCollector(t *testing.T) {
+	proc := t.TempDir()
+	writeCgroup(t, proc, "pressure", map[string]string{
+		"cpu":    "some avg10=1.50 avg60=0.80 avg300=0.20 total=90000\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n",
+		"memory": "some avg10=0.00 avg60=0.00 avg300=0.00 total=1500\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=700\n",
+	})
+
+	defer SetProcfs(procfs)
+	SetProcfs(proc)
+
+	c, err := NewNodePressureCollector(logger, nil)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_node_pressure_avg10{resource="cpu",type="some"} 1.5`,
+		`cgroupv2_node_pressure_total{resource="cpu",type="some"} 90000`,
+		`cgroupv2_node_pressure_total{resource="memory",type="full"} 700`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, `resource="io"`) {
+		t.Errorf("Expected no metrics for the missing io file, got:\n%s", out)
+	}
+
+	SetProcfs(t.TempDir())
+	if _, err := scrape(c); !errors.Is(err, ErrFileMissing) {
+		t.Errorf("Expected ErrFileMissing without /proc/pressure, got %v", err)
+	}
+}
+
+func TestCgroupProcsCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "app.service", map[string]string{"cgroup.procs": "101\n102\n4711\n65536\n"}),
+		writeCgroup(t, root, "idle.slice", map[string]string{"cgroup.procs": ""}),
+	}
+
+	c, err := NewCgroupProcsCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cgroup_procs{cgroup="app_service"} 4`,
+		`cgroupv2_cgroup_procs{cgroup="idle_slice"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	root := t.TempDir()
+	var stat, procs strings.Builder
+	stat.WriteString("anon 4096\nfile 8192\n")
+	for i := range 1000 {
+		fmt.Fprintf(&stat, "padding%d 1\n", i)
+		fmt.Fprintf(&procs, "%d\n", 1000+i)
+	}
+	app := writeCgroup(t, root, "app", map[string]string{
+		"memory.stat":  stat.String(),
+		"cgroup.procs": procs.String(),
+	})
+
+	*maxFileSize = 30
+	defer func() { *maxFileSize = 0 }()
+
+	c, err := NewMemoryStatCollector(logger, []string{app})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_stat{cgroup="app",stat="anon"} 4096`,
+		`cgroupv2_memory_stat{cgroup="app",stat="file"} 8192`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	// The first 30 bytes end within the padding0 line, which must be dropped
+	// rather than parsed from a partial line.
+	if strings.Contains(out, "padding") {
+		t.Errorf("Expected memory.stat to be capped after file, got:\n%s", out)
+	}
+
+	// Counting streams the file and isn't capped.
+	c, err = NewCgroupProcsCollector(logger, []string{app})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err = scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if expected := `cgroupv2_cgroup_procs{cgroup="app"} 1000`; !strings.Contains(out, expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, out)
+	}
+}
+
+func TestCgroupThreadsCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "app.service", map[string]string{"cgroup.type": "domain threaded\n", "cgroup.threads": "101\n"}),
+		writeCgroup(t, root, "workers", map[string]string{"cgroup.type": "threaded\n", "cgroup.threads": "201\n202\n203\n"}),
+		writeCgroup(t, root, "db.service", map[string]string{"cgroup.type": "domain\n", "cgroup.threads": "301\n302\n"}),
+	}
+
+	c, err := NewCgroupThreadsCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cgroup_threads{cgroup="app_service"} 1`,
+		`cgroupv2_cgroup_threads{cgroup="workers"} 3`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "db_service") {
+		t.Errorf("Expected no metrics for the domain cgroup, got:\n%s", out)
+	}
+
+	c, err = NewCgroupThreadsCollector(logger, cgroups[2:])
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !errors.Is(err, ErrNoData) {
+		t.Errorf("Expected ErrNoData without threaded cgroups, got %v", err)
+	}
+
+	// Unreadable files are reported like those of any file collector.
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		if filepath.Base(name) == "cgroup.threads" {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+		}
+		return os.Open(name)
+	}
+	c, err = NewCgroupThreadsCollector(logger, cgroups[1:2])
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !errors.Is(err, ErrPermission) {
+		t.Errorf("Expected ErrPermission for an unreadable cgroup.threads, got %v", err)
+	}
+}
+
+func TestPidsEventsLocalCollector(t *testing.T) {
+	root := t.TempDir()
+	parent := writeCgroup(t, root, "app.slice", map[string]string{
+		"pids.events":       "max 9\nmax.imposed 2\n",
+		"pids.events.local": "max 2\nmax.imposed 2\n",
+	})
+
+	ms := metrics.NewSet()
+	for _, newCollector := range []func(*slog.Logger, []string) (Collector, error){NewPidsEventsCollector, NewPidsEventsLocalCollector} {
+		c, err := newCollector(logger, []string{parent})
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		if err := c.Update(ms); err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+	}
+	// GetOrCreateFloatCounter panics if the series was registered as a gauge.
+	for id, expected := range map[string]float64{
+		`cgroupv2_pids_events{cgroup="app_slice",stat="max"}`:               9,
+		`cgroupv2_pids_events{cgroup="app_slice",stat="max.imposed"}`:       2,
+		`cgroupv2_pids_events_local{cgroup="app_slice",stat="max"}`:         2,
+		`cgroupv2_pids_events_local{cgroup="app_slice",stat="max.imposed"}`: 2,
+	} {
+		if v := ms.GetOrCreateFloatCounter(id).Get(); v != expected {
+			t.Errorf("Expected %s to be %f, got %f", id, expected, v)
+		}
+	}
+
+	// Kernels before 6.13 have no pids.events.local.
+	old := writeCgroup(t, root, "old.slice", map[string]string{"pids.events": "max 1\n"})
+	c, err := NewPidsEventsLocalCollector(logger, []string{old})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if err := c.Update(metrics.NewSet()); !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData without pids.events.local, got %v", err)
+	}
+}
+
+func TestLabelDependentIsCounter(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.stat": "anon 4096\npgfault 12\n"})}
+
+	c, err := NewMemoryStatCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	ms := metrics.NewSet()
+	if err := c.Update(ms); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+
+	// The stat key is only a label, so the classification can only come from
+	// the labels. Counters go to their own family, as a family has one type.
+	// The GetOrCreate calls panic if the series was registered with the other type.
+	if v := ms.GetOrCreateGauge(`cgroupv2_memory_stat{cgroup="app",stat="anon"}`, nil).Get(); v != 4096 {
+		t.Errorf("Expected anon gauge 4096, got %f", v)
+	}
+	if v := ms.GetOrCreateFloatCounter(`cgroupv2_memory_stat_total{cgroup="app",stat="pgfault"}`).Get(); v != 12 {
+		t.Errorf("Expected pgfault counter 12, got %f", v)
+	}
+}
+
+func TestSeriesEmittedOnce(t *testing.T) {
+	for _, n := range []int{1, 10, 50} {
+		root := t.TempDir()
+		var cgroups []string
+		for i := range n {
+			cgroups = append(cgroups, writeCgroup(t, root, fmt.Sprintf("app%d", i), map[string]string{"memory.stat": "anon 4096\nfile 8192\npgfault 12\n"}))
+		}
+		var logs bytes.Buffer
+		c, err := NewMemoryStatCollector(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})), cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		if logs.Len() > 0 {
+			t.Errorf("Expected no warnings for %d cgroups, got:\n%s", n, logs.String())
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != 3*n {
+			t.Errorf("Expected %d series for %d cgroups, got %d", 3*n, n, len(lines))
+		}
+		seen := make(map[string]bool, len(lines))
+		for _, line := range lines {
+			series, _, _ := strings.Cut(line, " ")
+			if seen[series] {
+				t.Errorf("Expected %s once, got it repeatedly", series)
+			}
+			seen[series] = true
+		}
+	}
+}
+
+func TestMemoryStatWorkingsetCounters(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.stat": "workingset_refault_anon 7\n" +
+		"workingset_refault_file 42\nworkingset_activate_file 5\nworkingset_nodes 3\n"})}
+
+	for _, layout := range []string{layoutLabel, layoutName} {
+		*memoryStatLayout = layout
+		c, err := NewMemoryStatCollector(logger, cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		ms := metrics.NewSet()
+		if err := c.Update(ms); err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+
+		// The GetOrCreate calls panic if the series was registered with the other type.
+		refault, nodes := `cgroupv2_memory_stat_total{cgroup="app",stat="workingset_refault_file"}`, `cgroupv2_memory_stat{cgroup="app",stat="workingset_nodes"}`
+		if layout == layoutName {
+			refault, nodes = `cgroupv2_memory_stat_workingset_refault_file_total{cgroup="app"}`, `cgroupv2_memory_stat_workingset_nodes{cgroup="app"}`
+		}
+		if v := ms.GetOrCreateFloatCounter(refault).Get(); v != 42 {
+			t.Errorf("Expected %s counter 42 in the %s layout, got %f", refault, layout, v)
+		}
+		if v := ms.GetOrCreateGauge(nodes, nil).Get(); v != 3 {
+			t.Errorf("Expected %s gauge 3 in the %s layout, got %f", nodes, layout, v)
+		}
+	}
+	*memoryStatLayout = layoutLabel
+}
+
+func TestMemoryStatReclaimKind(t *testing.T) {
+	root := t.TempDir()
+	stat := "anon 4096\npgscan 30\npgsteal 20\npgscan_kswapd 25\npgscan_direct 5\npgsteal_kswapd 18\npgsteal_direct 2\n"
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.stat": stat})}
+
+	for _, tc := range []struct {
+		layout      string
+		reclaimKind bool
+		expected    []string
+	}{
+		{
+			layout: layoutLabel,
+			expected: []string{
+				`cgroupv2_memory_stat_total{cgroup="app",stat="pgscan"} 30`,
+				`cgroupv2_memory_stat_total{cgroup="app",stat="pgscan_kswapd"} 25`,
+				`cgroupv2_memory_stat_total{cgroup="app",stat="pgsteal_direct"} 2`,
+			},
+		},
+		{
+			layout:      layoutLabel,
+			reclaimKind: true,
+			expected: []string{
+				`cgroupv2_memory_stat_total{cgroup="app",reclaim_kind="kswapd",stat="pgscan"} 25`,
+				`cgroupv2_memory_stat_total{cgroup="app",reclaim_kind="direct",stat="pgscan"} 5`,
+				`cgroupv2_memory_stat_total{cgroup="app",reclaim_kind="kswapd",stat="pgsteal"} 18`,
+				`cgroupv2_memory_stat_total{cgroup="app",reclaim_kind="direct",stat="pgsteal"} 2`,
+			},
+		},
+		{
+			layout:      layoutName,
+			reclaimKind: true,
+			expected: []string{
+				`cgroupv2_memory_stat_pgscan_total{cgroup="app",reclaim_kind="kswapd"} 25`,
+				`cgroupv2_memory_stat_pgsteal_total{cgroup="app",reclaim_kind="direct"} 2`,
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("%s/%t", tc.layout, tc.reclaimKind), func(t *testing.T) {
+			*memoryStatLayout, *memoryStatReclaimKind = tc.layout, tc.reclaimKind
+			defer func() { *memoryStatLayout, *memoryStatReclaimKind = layoutLabel, false }()
+
+			c, err := NewMemoryStatCollector(logger, cgroups)
+			if err != nil {
+				t.Fatalf("Error creating collector: %v", err)
+			}
+			out, err := scrape(c)
+			if err != nil {
+				t.Fatalf("Error calling Update: %v", err)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			// Only gauges go to the families without the _total suffix.
+			for _, line := range strings.Split(out, "\n") {
+				if strings.Contains(line, "pgscan") || strings.Contains(line, "pgsteal") {
+					if name, _, _ := strings.Cut(line, "{"); !strings.HasSuffix(name, "_total") {
+						t.Errorf("Expected reclaim stats to be counters, got %s", line)
+					}
+					// The totals would be counted twice when summing over reclaim_kind.
+					if tc.reclaimKind && !strings.Contains(line, "reclaim_kind=") {
+						t.Errorf("Expected no reclaim total with reclaim_kind, got %s", line)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStatLayout(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.stat": "anon 4096\nfile 8192\npgfault 12\npgmajfault 3\n"})}
+
+	for _, tc := range []struct {
+		layout   string
+		expected []string
+	}{
+		{
+			layout: layoutLabel,
+			expected: []string{
+				`cgroupv2_memory_stat{cgroup="app",stat="anon"} 4096`,
+				`cgroupv2_memory_stat{cgroup="app",stat="file"} 8192`,
+				`cgroupv2_memory_stat_total{cgroup="app",stat="pgfault"} 12`,
+				`cgroupv2_memory_stat_total{cgroup="app",stat="pgmajfault"} 3`,
+			},
+		},
+		{
+			layout: layoutName,
+			expected: []string{
+				`cgroupv2_memory_stat_anon{cgroup="app"} 4096`,
+				`cgroupv2_memory_stat_file{cgroup="app"} 8192`,
+				`cgroupv2_memory_stat_pgfault_total{cgroup="app"} 12`,
+				`cgroupv2_memory_stat_pgmajfault_total{cgroup="app"} 3`,
+			},
+		},
+	} {
+		t.Run(tc.layout, func(t *testing.T) {
+			*memoryStatLayout = tc.layout
+			defer func() { *memoryStatLayout = layoutLabel }()
+
+			c, err := NewMemoryStatCollector(logger, cgroups)
+			if err != nil {
+				t.Fatalf("Error creating collector: %v", err)
+			}
+			out, err := scrape(c)
+			if err != nil {
+				t.Fatalf("Error calling Update: %v", err)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+
+			families := make(map[string]bool)
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				name, _, _ := strings.Cut(line, "{")
+				families[name] = true
+			}
+			if tc.layout == layoutLabel && len(families) != 2 {
+				t.Errorf("Expected one gauge and one counter family, got %v", families)
+			}
+		})
+	}
+}
+
+func TestUnitLabel(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{
+		"memory.current": "4096\n",
+		"memory.max":     "8192\n",
+		"cpu.stat":       "usage_usec 100\nnr_periods 5\n",
+		"pids.current":   "3\n",
+	})}
+
+	defer func(orig bool) { *unitLabel = orig }(*unitLabel)
+	*unitLabel = true
+
+	var out strings.Builder
+	for _, newCollector := range []func(*slog.Logger, []string) (Collector, error){
+		NewMemoryCurrentCollector, NewCpuStatCollector, NewPidsCurrentCollector, NewMemoryUtilizationCollector,
+	} {
+		c, err := newCollector(logger, cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		o, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		out.WriteString(o)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="app",unit="bytes"} 4096`,
+		`cgroupv2_cpu_stat{cgroup="app",stat="usage_usec",unit="microseconds"} 100`,
+		`cgroupv2_cpu_stat{cgroup="app",stat="nr_periods"} 5`,
+		`cgroupv2_pids_current{cgroup="app"} 3`,
+		`cgroupv2_memory_utilization_ratio{cgroup="app",unit="ratio"} 0.5`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestStaticLabels(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{
+		"memory.current": "4096\n",
+		"io.stat":        "8:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+	})}
+
+	if err := setStaticLabels([]string{"datacenter=fra1", "role=db"}); err != nil {
+		t.Fatalf("Error setting static labels: %v", err)
+	}
+	defer setStaticLabels(nil)
+	// Counters left by other tests have their ids formatted without the labels.
+	defer func(orig *counterSet) { skippedCgroups = orig }(skippedCgroups)
+	skippedCgroups = newCounterSet()
+
+	cgc, err := NewCgroupv2SubsetCollector(cgroups, logger, "memory.current", "io.stat")
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	ms := metrics.NewSet()
+	cgc.Scrape(ms)
+	var buf bytes.Buffer
+	ms.WritePrometheus(&buf)
+
+	if !strings.Contains(buf.String(), `cgroupv2_memory_current{cgroup="app",datacenter="fra1",role="db"} 4096`) {
+		t.Errorf("Expected static labels next to the cgroup label, got:\n%s", buf.String())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, `datacenter="fra1"`) || !strings.Contains(line, `role="db"`) {
+			t.Errorf("Expected static labels on %s", line)
+		}
+	}
+
+	for _, spec := range []string{"datacenter", "cgroup=foo", "__name__=foo", "1dc=foo", "role=a\xff", "role=a"} {
+		if err := setStaticLabels([]string{"role=db", spec}); err == nil {
+			t.Errorf("Expected static label %q to be rejected", spec)
+		}
+	}
+}
+
+func TestCounterOverride(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.current": "4096\n"})}
+
+	if err := setCounterOverrides([]string{"cgroupv2_memory_*=counter", "cgroupv2_memory_current=gauge"}); err != nil {
+		t.Fatalf("Error setting overrides: %v", err)
+	}
+	defer setCounterOverrides(nil)
+
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	ms := metrics.NewSet()
+	if err := c.Update(ms); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("Expected memory.current to be overridden to a counter: %v", r)
+		}
+	}()
+	// The first matching override wins. GetOrCreateFloatCounter panics on a gauge.
+	if v := ms.GetOrCreateFloatCounter(`cgroupv2_memory_current{cgroup="app"}`).Get(); v != 4096 {
+		t.Errorf("Expected counter value 4096, got %f", v)
+	}
+
+	for _, spec := range []string{"cgroupv2_memory_current", "cgroupv2_memory_current=histogram", "[=gauge"} {
+		if err := setCounterOverrides([]string{spec}); err == nil {
+			t.Errorf("Expected override %q to be rejected", spec)
+		}
+	}
+}
+
+func TestIsPressureTotalField(t *testing.T) {
+	tests := []struct {
+		metricName string
+		labels     map[string]string
+		expected   bool
+	}{
+		{"memory_pressure", map[string]string{"type": "some", "window": "total"}, true},
+		{"memory_pressure", map[string]string{"type": "some", "window": "avg10"}, false},
+		{"memory_pressure", map[string]string{"type": "full", "window": "avg300"}, false},
+		{"memory_pressure_total", map[string]string{"type": "some"}, true},
+		{"memory_pressure_avg10", map[string]string{"type": "some"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := isPressureTotalField(tt.metricName, tt.labels); got != tt.expected {
+			t.Errorf("isPressureTotalField(%s, %v) = %v, expected %v", tt.metricName, tt.labels, got, tt.expected)
+		}
+	}
+}
+
+func TestPsiLayout(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{
+		"memory.pressure": "some avg10=1.50 avg60=0.00 avg300=0.00 total=100\nfull avg10=0.50 avg60=0.00 avg300=0.00 total=40\n",
+	})}
+
+	for _, tc := range []struct {
+		layout   string
+		expected []string
+	}{
+		{
+			layout: layoutLabel,
+			expected: []string{
+				`cgroupv2_memory_pressure_avg10{cgroup="app",type="some"} 1.5`,
+				`cgroupv2_memory_pressure_total{cgroup="app",type="full"} 40`,
+			},
+		},
+		{
+			layout: layoutName,
+			expected: []string{
+				`cgroupv2_memory_pressure_some_avg10{cgroup="app"} 1.5`,
+				`cgroupv2_memory_pressure_full_total{cgroup="app"} 40`,
+			},
+		},
+	} {
+		t.Run(tc.layout, func(t *testing.T) {
+			*psiLayout = tc.layout
+			defer func() { *psiLayout = layoutLabel }()
+
+			c, err := NewMemoryPressureCollector(logger, cgroups)
+			if err != nil {
+				t.Fatalf("Error creating collector: %v", err)
+			}
+			out, err := scrape(c)
+			if err != nil {
+				t.Fatalf("Error calling Update: %v", err)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestCpuStatRootAndLocal(t *testing.T) {
+	root := t.TempDir()
+	// The root cgroup has only the usage fields and no cpu.stat.local.
+	cgroups := []string{
+		writeCgroup(t, root, "root", map[string]string{
+			"cpu.stat": "usage_usec 5000\nuser_usec 3000\nsystem_usec 2000\ncore_sched.force_idle_usec 0\n",
+		}),
+		writeCgroup(t, root, "app", map[string]string{
+			"cpu.stat":       "usage_usec 100\nuser_usec 60\nsystem_usec 40\nnr_periods 10\nnr_throttled 2\nthrottled_usec 500\n",
+			"cpu.stat.local": "throttled_usec 300\n",
+		}),
+	}
+
+	stat, err := NewCpuStatCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(stat)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cpu_stat{cgroup="root",stat="usage_usec"} 5000`,
+		`cgroupv2_cpu_stat{cgroup="app",stat="throttled_usec"} 500`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	local, err := NewCpuStatLocalCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err = scrape(local)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroupv2_cpu_stat_local{cgroup="app",stat="throttled_usec"} 300`) {
+		t.Errorf("Expected cpu.stat.local series, got:\n%s", out)
+	}
+	if strings.Contains(out, `cgroup="root"`) {
+		t.Errorf("Expected no cpu.stat.local series for the root cgroup, got:\n%s", out)
+	}
+}
+
+func TestCPUSetEffectiveCollectors(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "pinned", map[string]string{
+		"cpuset.cpus.effective": "0-2,8\n",
+		"cpuset.mems.effective": "0-1\n",
+	})}
+
+	for _, tc := range []struct {
+		factory  func(*slog.Logger, []string) (Collector, error)
+		expected []string
+	}{
+		{
+			factory: NewCPUSetCpusEffectiveCollector,
+			expected: []string{
+				`cgroupv2_cpuset_cpus_effective{cgroup="pinned",cpu="0"} 1`,
+				`cgroupv2_cpuset_cpus_effective{cgroup="pinned",cpu="1"} 1`,
+				`cgroupv2_cpuset_cpus_effective{cgroup="pinned",cpu="2"} 1`,
+				`cgroupv2_cpuset_cpus_effective{cgroup="pinned",cpu="8"} 1`,
+			},
+		},
+		{
+			factory: NewCPUSetMemsEffectiveCollector,
+			expected: []string{
+				`cgroupv2_cpuset_mems_effective{cgroup="pinned",numanode="0"} 1`,
+				`cgroupv2_cpuset_mems_effective{cgroup="pinned",numanode="1"} 1`,
+			},
+		},
+	} {
+		c, err := tc.factory(logger, cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %s, got:\n%s", expected, out)
+			}
+		}
+		if n := strings.Count(out, "\n"); n != len(tc.expected) {
+			t.Errorf("Expected %d series, got %d:\n%s", len(tc.expected), n, out)
+		}
+	}
+}
+
+func TestCpuIdleCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "idle", map[string]string{"cpu.idle": "1\n"}),
+		writeCgroup(t, root, "normal", map[string]string{"cpu.idle": "0\n"}),
+		writeCgroup(t, root, "old", nil),
+	}
+
+	c, err := NewCpuIdleCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cpu_idle{cgroup="idle"} 1`,
+		`cgroupv2_cpu_idle{cgroup="normal"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, `cgroup="old"`) {
+		t.Errorf("Expected no series for cgroup without cpu.idle, got:\n%s", out)
+	}
+
+	c, err = NewCpuIdleCollector(logger, cgroups[2:])
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData without cpu.idle, got %v", err)
+	}
+}
+
+func TestCPUSetPartitionCollector(t *testing.T) {
+	for content, state := range map[string]string{
+		"member\n":   "member",
+		"root\n":     "root",
+		"isolated\n": "isolated",
+		"root invalid (Cpu list in cpuset.cpus not exclusive)\n": "root invalid",
+		"isolated invalid\n": "isolated invalid",
+	} {
+		root := t.TempDir()
+		cgroups := []string{writeCgroup(t, root, "app", map[string]string{"cpuset.cpus.partition": content})}
+		c, err := NewCPUSetPartitionCollector(logger, cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		expected := `cgroupv2_cpuset_partition{cgroup="app",state="` + state + `"} 1` + "\n"
+		if out != expected {
+			t.Errorf("Expected %s for %q, got:\n%s", expected, content, out)
+		}
+	}
+}
+
+func TestIoStatDevices(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "two", map[string]string{"io.stat": "8:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n" +
+			"259:0 rbytes=2048 wbytes=512 rios=2 wios=1 dbytes=0 dios=0\n"}),
+		writeCgroup(t, root, "idle", map[string]string{"io.stat": ""}),
+	}
+
+	c, err := NewIoStatCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_io_stat_devices{cgroup="two"} 2`,
+		`cgroupv2_io_stat_devices{cgroup="idle"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestIoStatAverages(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"io.stat": "8:0 rbytes=12288 wbytes=0 rios=3 wios=0 dbytes=0 dios=0\n" +
+		"259:0 rbytes=0 wbytes=3072 rios=0 wios=2 dbytes=0 dios=0\n"})}
+
+	c, err := NewIoStatCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_io_stat_avg_read_bytes{cgroup="app",device="8:0"} 4096`,
+		`cgroupv2_io_stat_avg_write_bytes{cgroup="app",device="259:0"} 1536`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{
+		`cgroupv2_io_stat_avg_write_bytes{cgroup="app",device="8:0"}`,
+		`cgroupv2_io_stat_avg_read_bytes{cgroup="app",device="259:0"}`,
+	} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("Expected no %s without requests, got:\n%s", unexpected, out)
+		}
+	}
+}
+
+func TestIoStatOmittedFields(t *testing.T) {
+	root := t.TempDir()
+	// Zero-valued fields are left out, so the devices have different keys.
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"io.stat": "8:0 rbytes=4096 rios=1\n" +
+		"259:0 wbytes=1024 wios=2 dbytes=512 dios=1\n"})}
+
+	c, err := NewIoStatCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	ms := metrics.NewSet()
+	if err := c.Update(ms); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	var buf bytes.Buffer
+	ms.WritePrometheus(&buf)
+	out := buf.String()
+	for _, expected := range []string{
+		`cgroupv2_io_stat_rbytes{cgroup="app",device="8:0"} 4096`,
+		`cgroupv2_io_stat_rios{cgroup="app",device="8:0"} 1`,
+		`cgroupv2_io_stat_avg_read_bytes{cgroup="app",device="8:0"} 4096`,
+		`cgroupv2_io_stat_wbytes{cgroup="app",device="259:0"} 1024`,
+		`cgroupv2_io_stat_wios{cgroup="app",device="259:0"} 2`,
+		`cgroupv2_io_stat_dbytes{cgroup="app",device="259:0"} 512`,
+		`cgroupv2_io_stat_avg_write_bytes{cgroup="app",device="259:0"} 512`,
+		`cgroupv2_io_stat_devices{cgroup="app"} 2`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{
+		`cgroupv2_io_stat_wbytes{cgroup="app",device="8:0"}`,
+		`cgroupv2_io_stat_rbytes{cgroup="app",device="259:0"}`,
+	} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("Expected no %s for an omitted field, got:\n%s", unexpected, out)
+		}
+	}
+}
+
+func TestIoStatUnknownField(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{
+		"io.stat": "8:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0 cost.vrate=100.00 newfield=7\n",
+	})}
+
+	var logs bytes.Buffer
+	c, err := NewIoStatCollector(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})), cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	ms := metrics.NewSet()
+	if err := c.Update(ms); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+
+	// The GetOrCreate calls panic if the series was registered with the other type.
+	if v := ms.GetOrCreateFloatCounter(`cgroupv2_io_stat_rbytes{cgroup="app",device="8:0"}`).Get(); v != 1024 {
+		t.Errorf("Expected rbytes counter 1024, got %f", v)
+	}
+	if v := ms.GetOrCreateGauge(`cgroupv2_io_stat_cost_vrate{cgroup="app",device="8:0"}`, nil).Get(); v != 100 {
+		t.Errorf("Expected cost.vrate gauge 100, got %f", v)
+	}
+	if v := ms.GetOrCreateGauge(`cgroupv2_io_stat_newfield{cgroup="app",device="8:0"}`, nil).Get(); v != 7 {
+		t.Errorf("Expected unknown field as gauge 7, got %f", v)
+	}
+	unknown := strings.Count(logs.String(), "unknown io.stat field")
+	if unknown != 1 || !strings.Contains(logs.String(), `as gauge" file=io.stat name=io_stat_newfield`) {
+		t.Errorf("Expected only the unknown field to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestIoCostCollectors(t *testing.T) {
+	root := writeCgroup(t, t.TempDir(), "cgroup", map[string]string{
+		"io.cost.qos":   "8:0 enable=1 ctrl=user rpct=95.00 rlat=10000 wpct=95.00 wlat=20000 min=50.00 max=150.00\n",
+		"io.cost.model": "8:0 ctrl=auto model=linear rbps=174019176 rseqiops=41708 rrandiops=370 wbps=178075866 wseqiops=42705 wrandiops=378\n",
+	})
+	writeCgroup(t, root, "system.slice", map[string]string{"memory.current": "1\n"})
+	writeCgroup(t, root, "user.slice", map[string]string{"memory.current": "2\n"})
+	unconfigured := writeCgroup(t, t.TempDir(), "cgroup", nil)
+	writeCgroup(t, unconfigured, "system.slice", nil)
+	defer func(orig string) { rootCgroup = orig }(rootCgroup)
+
+	for _, tc := range []struct {
+		name     string
+		expected []string
+	}{
+		{
+			name: "io.cost.qos",
+			expected: []string{
+				`cgroupv2_io_cost_qos_enable{cgroup="root",device="8:0"} 1`,
+				`cgroupv2_io_cost_qos_rlat{cgroup="root",device="8:0"} 10000`,
+				`cgroupv2_io_cost_qos_max{cgroup="root",device="8:0"} 150`,
+			},
+		},
+		{
+			name: "io.cost.model",
+			expected: []string{
+				`cgroupv2_io_cost_model_rbps{cgroup="root",device="8:0"} 174019176`,
+				`cgroupv2_io_cost_model_wrandiops{cgroup="root",device="8:0"} 378`,
+			},
+		},
+	} {
+		enabled := *collectorState[tc.name]
+		*collectorState[tc.name] = true
+		defer func() { *collectorState[tc.name] = enabled }()
+		defer delete(initiatedCollectors, tc.name)
+
+		// The default glob only discovers the children of the root cgroup.
+		SetRootCgroup(root)
+		cgroups := DiscoverCgroups([]string{root + "/*"}, logger)
+		delete(initiatedCollectors, tc.name)
+		cgc, err := NewCgroupv2Collector(cgroups, logger, tc.name)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(cgc.Collectors[tc.name])
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %s, got:\n%s", expected, out)
+			}
+		}
+		if strings.Contains(out, "_ctrl") || strings.Contains(out, "_model{") {
+			t.Errorf("Expected non-numeric keys to be skipped, got:\n%s", out)
+		}
+		if available := CheckAvailability(cgroups[0], logger); !available[tc.name] {
+			t.Errorf("Expected %s available from the root cgroup", tc.name)
+		}
+
+		SetRootCgroup(unconfigured)
+		delete(initiatedCollectors, tc.name)
+		cgc, err = NewCgroupv2Collector(DiscoverCgroups([]string{unconfigured + "/*"}, logger), logger, tc.name)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		if _, err := scrape(cgc.Collectors[tc.name]); !IsNoDataError(err) {
+			t.Errorf("Expected ErrNoData without io.cost, got %v", err)
+		}
+	}
+}
+
+func TestCountOpenFDs(t *testing.T) {
+	before, err := countOpenFDs()
+	if err != nil {
+		t.Fatalf("Error counting file descriptors: %v", err)
+	}
+	for range 3 {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatalf("Error opening %s: %v", os.DevNull, err)
+		}
+		defer f.Close()
+	}
+	after, err := countOpenFDs()
+	if err != nil {
+		t.Fatalf("Error counting file descriptors: %v", err)
+	}
+	if after-before != 3 {
+		t.Errorf("Expected 3 more file descriptors after opening 3 files, got %d before and %d after", before, after)
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	for _, name := range []string{"collector.memory.current", "collector.zero-fill", "web.drop-inf"} {
+		if kingpin.CommandLine.GetFlag(name) != nil {
+			t.Errorf("Expected flag %s not to be registered on import", name)
+		}
+	}
+	if !*collectorState["memory.current"] || *collectorState["memory.stat"] {
+		t.Errorf("Expected collector defaults to apply without flags")
+	}
+
+	defer func(current, stat, fill bool) {
+		*collectorState["memory.current"], *collectorState["memory.stat"], *zeroFill = current, stat, fill
+		delete(forcedCollectors, "memory.current")
+		delete(forcedCollectors, "memory.stat")
+	}(*collectorState["memory.current"], *collectorState["memory.stat"], *zeroFill)
+
+	app := kingpin.New("test", "")
+	RegisterFlags(app)
+	if _, err := app.Parse([]string{"--no-collector.memory.current", "--collector.memory.stat", "--collector.zero-fill"}); err != nil {
+		t.Fatalf("Error parsing flags: %v", err)
+	}
+	if *collectorState["memory.current"] || !*collectorState["memory.stat"] || !*zeroFill {
+		t.Errorf("Expected flags bound to app to set the collector state")
+	}
+	if kingpin.CommandLine.GetFlag("collector.memory.current") != nil {
+		t.Errorf("Expected no flags on the default command line")
+	}
+}
+
+func TestDisableAbsentControllers(t *testing.T) {
+	saved := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		saved[name] = *enabled
+	}
+	defer func() {
+		for name, enabled := range saved {
+			*collectorState[name] = enabled
+		}
+		delete(forcedCollectors, "io.cost.qos")
+	}()
+
+	app := kingpin.New("test", "")
+	RegisterFlags(app)
+	if _, err := app.Parse([]string{"--collector.io.stat", "--collector.io.cost.qos", "--collector.memory.current"}); err != nil {
+		t.Fatalf("Error parsing flags: %v", err)
+	}
+	// io.stat is only enabled by default here, not forced.
+	delete(forcedCollectors, "io.stat")
+	delete(forcedCollectors, "memory.current")
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpuset cpu memory pids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	disabled := DisableAbsentControllers(root, logger)
+	if !slices.Equal(disabled, []string{"io.stat"}) {
+		t.Errorf("Expected only io.stat to be disabled, got %v", disabled)
+	}
+	if *collectorState["io.stat"] {
+		t.Errorf("Expected io.stat to be disabled without the io controller")
+	}
+	if !*collectorState["io.cost.qos"] {
+		t.Errorf("Expected explicitly enabled io.cost.qos to stay enabled")
+	}
+	for _, name := range []string{"io.pressure", "memory.current", "cpu.stat"} {
+		if !*collectorState[name] {
+			t.Errorf("Expected %s to stay enabled", name)
+		}
+	}
+
+	if disabled := DisableAbsentControllers(t.TempDir(), logger); disabled != nil {
+		t.Errorf("Expected no collectors disabled without cgroup.controllers, got %v", disabled)
+	}
+}
+
+func TestCheckEnabledCollectors(t *testing.T) {
+	if err := CheckEnabledCollectors(logger); err != nil {
+		t.Errorf("Expected the default collectors to pass, got %v", err)
+	}
+
+	saved := make(map[string]bool, len(collectorState))
+	for name, enabled := range collectorState {
+		saved[name] = *enabled
+	}
+	defer func() {
+		for name, enabled := range saved {
+			*collectorState[name] = enabled
+		}
+	}()
+	DisableDefaultCollectors()
+
+	if err := CheckEnabledCollectors(logger); !errors.Is(err, ErrNoCollectors) {
+		t.Errorf("Expected ErrNoCollectors with all collectors disabled, got %v", err)
+	}
+	defer func(orig bool) { *allowEmpty = orig }(*allowEmpty)
+	*allowEmpty = true
+	if err := CheckEnabledCollectors(logger); err != nil {
+		t.Errorf("Expected no error with --collector.allow-empty, got %v", err)
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{
+		"memory.current": "100\n",
+		"memory.stat":    "anon 10\n",
+	})}
+
+	// memory.stat is disabled by default and no flags have been parsed here.
+	cgc, err := NewRegistry(RegistryOpts{Cgroups: cgroups, Collectors: []string{"memory.current", "memory.stat"}})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if len(cgc.Collectors) != 2 {
+		t.Errorf("Expected 2 collectors, got %d", len(cgc.Collectors))
+	}
+	ms := metrics.NewSet()
+	cgc.Scrape(ms)
+	var b bytes.Buffer
+	ms.WritePrometheus(&b)
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="app"} 100`,
+		`cgroupv2_memory_stat{cgroup="app",stat="anon"} 10`,
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, b.String())
+		}
+	}
+
+	cgc, err = NewRegistry(RegistryOpts{Cgroups: cgroups})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	for name, enabled := range RegisteredCollectors() {
+		if _, ok := cgc.Collectors[name]; ok != enabled {
+			t.Errorf("Expected collector %s to be enabled %t by default, got %t", name, enabled, ok)
+		}
+	}
+
+	if _, err := NewRegistry(RegistryOpts{Collectors: []string{"nope"}}); err == nil {
+		t.Errorf("Expected an error for an unknown collector")
+	}
+}
+
+func TestPsiHistogram(t *testing.T) {
+	root := t.TempDir()
+	dir := writeCgroup(t, root, "histogram", nil)
+	writePressure := func(some, full int) {
+		content := fmt.Sprintf("some avg10=0.00 avg60=0.00 avg300=0.00 total=%d\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=%d\n", some, full)
+		if err := os.WriteFile(filepath.Join(dir, "memory.pressure"), []byte(content), 0o644); err != nil {
+			t.Fatalf("Error writing memory.pressure: %v", err)
+		}
+	}
+
+	*psiHistogram = true
+	defer func() { *psiHistogram = false }()
+
+	c, err := NewMemoryPressureCollector(logger, []string{dir})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	writePressure(1000, 400)
+	if _, err := scrape(c); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	writePressure(1150, 400)
+	if _, err := scrape(c); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+
+	ms := metrics.NewSet()
+	stallHistograms.writeTo(ms)
+	var b bytes.Buffer
+	ms.WritePrometheus(&b)
+	out := b.String()
+	for _, expected := range []string{
+		`cgroupv2_memory_pressure_stall_microseconds_sum{cgroup="histogram",type="some"} 150`,
+		`cgroupv2_memory_pressure_stall_microseconds_count{cgroup="histogram",type="some"} 1`,
+		`cgroupv2_memory_pressure_stall_microseconds_count{cgroup="histogram",type="full"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	// A subset scrape keeps the histogram, an unfiltered one without the cgroup drops it.
+	c.(*Cgroupv2FileCollector).dirNames = nil
+	for _, subset := range []bool{true, false} {
+		cgc := &Cgroup2Collector{Collectors: map[string]Collector{"memory.pressure": c}, logger: logger, subset: subset}
+		cgc.Scrape(metrics.NewSet())
+		stallHistograms.mtx.Lock()
+		n := len(stallHistograms.histograms)
+		stallHistograms.mtx.Unlock()
+		if subset && n != 2 || !subset && n != 0 {
+			t.Errorf("Expected the histograms kept only by a subset scrape (subset %t), got %d", subset, n)
+		}
+	}
+}
+
+func TestCpuPressureFullAvailable(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "old", map[string]string{"cpu.pressure": "some avg10=1.00 avg60=0.00 avg300=0.00 total=10\n"}),
+		writeCgroup(t, root, "new", map[string]string{"cpu.pressure": "some avg10=1.00 avg60=0.00 avg300=0.00 total=10\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=5\n"}),
+	}
+
+	for _, layout := range []string{layoutLabel, layoutName} {
+		*psiLayout = layout
+		c, err := NewCpuPressureCollector(logger, cgroups)
+		*psiLayout = layoutLabel
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		for _, expected := range []string{
+			`cgroupv2_cpu_pressure_full_available{cgroup="old"} 0`,
+			`cgroupv2_cpu_pressure_full_available{cgroup="new"} 1`,
+		} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %s with layout %s, got:\n%s", expected, layout, out)
+			}
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, `cgroup="old"`) && (strings.Contains(line, `type="full"`) || strings.Contains(line, "_full_total") || strings.Contains(line, "_full_avg")) {
+				t.Errorf("Expected no synthesized full line, got %s", line)
+			}
+		}
+	}
+}
+
+func TestParseUnitsBytesOnly(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.current": "1K\n", "pids.current": "1K\n"})}
+	*parseUnits = true
+	defer func() { *parseUnits = false }()
+
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if out, _ := scrape(c); !strings.Contains(out, `cgroupv2_memory_current{cgroup="app"} 1024`) {
+		t.Errorf("Expected memory.current of 1024 bytes, got:\n%s", out)
+	}
+
+	// pids.current is a count, not a size.
+	c, err = NewPidsCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if out, err := scrape(c); err == nil || strings.Contains(out, "cgroupv2_pids_current") {
+		t.Errorf("Expected 1K pids to fail parsing, got %v:\n%s", err, out)
+	}
+}
+
+func TestCheckAvailability(t *testing.T) {
+	root := t.TempDir()
+	cgroup := writeCgroup(t, root, "first", map[string]string{
+		"cpu.stat":       "usage_usec 10\n",
+		"memory.current": "4096\n",
+		"memory.max":     "8192\n",
+	})
+
+	available := CheckAvailability(cgroup, logger)
+
+	for _, name := range []string{"cpu.stat", "memory.current"} {
+		if !available[name] {
+			t.Errorf("Expected %s to be available", name)
+		}
+	}
+	for _, name := range []string{"io.stat", "memory.swap.current", "pids.events"} {
+		ok, found := available[name]
+		if !found {
+			t.Errorf("Expected %s to be reported", name)
+		}
+		if ok {
+			t.Errorf("Expected %s to be unavailable", name)
+		}
+	}
+
+	// Collectors deriving metrics are checked too.
+	if !available["memory.utilization"] {
+		t.Errorf("Expected memory.utilization to be reported available, got %v", available)
+	}
+	if ok, found := available["cgroup.is_leaf"]; !found || !ok {
+		t.Errorf("Expected cgroup.is_leaf to be reported available, got %v", available)
+	}
+	// Disabled collectors aren't checked.
+	if _, found := available["memory.stat"]; found {
+		t.Errorf("Expected disabled memory.stat not to be checked")
+	}
+
+	for name, factory := range factories {
+		c, err := factory(logger, []string{cgroup})
+		if err != nil {
+			t.Fatalf("Error creating collector %s: %v", name, err)
+		}
+		if _, ok := c.(availabilityChecker); !ok {
+			t.Errorf("Expected collector %s to implement availabilityChecker", name)
+		}
+	}
+
+	if id := AvailableMetric("io.stat"); id != `cgroupv2_collector_available{collector="io.stat"}` {
+		t.Errorf("Unexpected availability metric id %s", id)
+	}
+}
+
+func TestMemoryPeakCollector(t *testing.T) {
+	root := t.TempDir()
+	present := []string{writeCgroup(t, root, "present", map[string]string{"memory.peak": "8192\n"})}
+	absent := []string{writeCgroup(t, root, "absent", nil)}
+
+	c, err := NewMemoryPeakCollector(logger, present)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_peak{cgroup="present"} 8192`) {
+		t.Errorf("Expected memory.peak gauge, got:\n%s", out)
+	}
+
+	c, err = NewMemoryPeakCollector(logger, absent)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err = scrape(c)
+	if !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData for missing memory.peak, got %v", err)
+	}
+	if out != "" {
+		t.Errorf("Expected no series for missing memory.peak, got:\n%s", out)
+	}
+}
+
+func TestMemorySwapPeakCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "present", map[string]string{"memory.swap.peak": "2048\n"}),
+		writeCgroup(t, root, "absent", nil),
+	}
+
+	c, err := NewMemorySwapPeakCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_swap_peak{cgroup="present"} 2048`) {
+		t.Errorf("Expected memory.swap.peak gauge, got:\n%s", out)
+	}
+	if strings.Contains(out, `cgroup="absent"`) {
+		t.Errorf("Expected no series for cgroup without memory.swap.peak, got:\n%s", out)
+	}
+
+	c, err = NewMemorySwapPeakCollector(logger, cgroups[1:])
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData for missing memory.swap.peak, got %v", err)
+	}
+}
+
+func TestMemoryZswapCollectors(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "limited", map[string]string{"memory.zswap.current": "4096\n", "memory.zswap.max": "1048576\n"}),
+		writeCgroup(t, root, "unlimited", map[string]string{"memory.zswap.current": "0\n", "memory.zswap.max": "max\n"}),
+		writeCgroup(t, root, "nozswap", nil),
+	}
+
+	for _, tc := range []struct {
+		factory  func(*slog.Logger, []string) (Collector, error)
+		expected []string
+	}{
+		{
+			factory: NewMemoryZswapCurrentCollector,
+			expected: []string{
+				`cgroupv2_memory_zswap_current{cgroup="limited"} 4096`,
+				`cgroupv2_memory_zswap_current{cgroup="unlimited"} 0`,
+			},
+		},
+		{
+			factory: NewMemoryZswapMaxCollector,
+			expected: []string{
+				`cgroupv2_memory_zswap_max{cgroup="limited"} 1048576`,
+				`cgroupv2_memory_zswap_max{cgroup="unlimited"} +Inf`,
+			},
+		},
+	} {
+		c, err := tc.factory(logger, cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %s, got:\n%s", expected, out)
+			}
+		}
+		if strings.Contains(out, `cgroup="nozswap"`) {
+			t.Errorf("Expected no series for cgroup without zswap, got:\n%s", out)
+		}
+
+		c, err = tc.factory(logger, cgroups[2:])
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		if _, err := scrape(c); !IsNoDataError(err) {
+			t.Errorf("Expected ErrNoData without zswap, got %v", err)
+		}
+	}
+}
+
+func TestMemoryZswapWritebackCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "enabled", map[string]string{"memory.zswap.writeback": "1\n"}),
+		writeCgroup(t, root, "disabled", map[string]string{"memory.zswap.writeback": "0\n"}),
+		writeCgroup(t, root, "nozswap", nil),
+	}
+
+	c, err := NewMemoryZswapWritebackCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_zswap_writeback{cgroup="enabled"} 1`,
+		`cgroupv2_memory_zswap_writeback{cgroup="disabled"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	c, err = NewMemoryZswapWritebackCollector(logger, cgroups[2:])
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData without zswap, got %v", err)
+	}
+}
+
+func TestCgroupMaxCollectors(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "limited", map[string]string{
+			"cgroup.max.descendants": "100\n",
+			"cgroup.max.depth":       "3\n",
+		}),
+		writeCgroup(t, root, "unlimited", map[string]string{
+			"cgroup.max.descendants": "max\n",
+			"cgroup.max.depth":       "max\n",
+		}),
+	}
+
+	for _, tc := range []struct {
+		factory  func(*slog.Logger, []string) (Collector, error)
+		expected []string
+	}{
+		{
+			factory: NewCgroupMaxDescendantsCollector,
+			expected: []string{
+				`cgroupv2_cgroup_max_descendants{cgroup="limited"} 100`,
+				`cgroupv2_cgroup_max_descendants{cgroup="unlimited"} +Inf`,
+			},
+		},
+		{
+			factory: NewCgroupMaxDepthCollector,
+			expected: []string{
+				`cgroupv2_cgroup_max_depth{cgroup="limited"} 3`,
+				`cgroupv2_cgroup_max_depth{cgroup="unlimited"} +Inf`,
+			},
+		},
+	} {
+		c, err := tc.factory(logger, cgroups)
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		out, err := scrape(c)
+		if err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %s, got:\n%s", expected, out)
+			}
+		}
+	}
+}
+
+func TestMemoryUtilizationCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "limited", map[string]string{"memory.current": "256\n", "memory.max": "1024\n"}),
+		writeCgroup(t, root, "unlimited", map[string]string{"memory.current": "256\n", "memory.max": "max\n"}),
+		writeCgroup(t, root, "nolimitfile", map[string]string{"memory.current": "256\n"}),
+	}
+
+	c, err := NewMemoryUtilizationCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_utilization_ratio{cgroup="limited"} 0.25`) {
+		t.Errorf("Expected utilization ratio of limited cgroup, got:\n%s", out)
+	}
+	for _, cgroup := range []string{"unlimited", "nolimitfile"} {
+		if strings.Contains(out, `cgroup="`+cgroup+`"`) {
+			t.Errorf("Expected no ratio for cgroup %s, got:\n%s", cgroup, out)
+		}
+	}
+
+	c, err = NewMemoryUtilizationCollector(logger, cgroups[2:])
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData without memory.max, got %v", err)
+	}
+}
+
+func TestMemoryOverHighCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "over", map[string]string{"memory.current": "2048\n", "memory.high": "1024\n"}),
+		writeCgroup(t, root, "under", map[string]string{"memory.current": "512\n", "memory.high": "1024\n"}),
+		writeCgroup(t, root, "unlimited", map[string]string{"memory.current": "512\n", "memory.high": "max\n"}),
+		writeCgroup(t, root, "nohighfile", map[string]string{"memory.current": "512\n"}),
+	}
+
+	c, err := NewMemoryOverHighCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_over_high{cgroup="over"} 1`,
+		`cgroupv2_memory_over_high{cgroup="under"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	for _, cgroup := range []string{"unlimited", "nohighfile"} {
+		if strings.Contains(out, `cgroup="`+cgroup+`"`) {
+			t.Errorf("Expected no gauge for cgroup %s, got:\n%s", cgroup, out)
+		}
+	}
+}
+
+func TestMemorySockCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "web", map[string]string{"memory.stat": "anon 4096\nsock 1024\n", "memory.current": "4096\n"}),
+		writeCgroup(t, root, "empty", map[string]string{"memory.stat": "anon 0\nsock 0\n", "memory.current": "0\n"}),
+		writeCgroup(t, root, "nosock", map[string]string{"memory.stat": "anon 4096\n", "memory.current": "4096\n"}),
+	}
+
+	c, err := NewMemorySockCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_sock_bytes{cgroup="web"} 1024`,
+		`cgroupv2_memory_sock_ratio{cgroup="web"} 0.25`,
+		`cgroupv2_memory_sock_bytes{cgroup="empty"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{`cgroupv2_memory_sock_ratio{cgroup="empty"}`, `cgroup="nosock"`} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("Expected no %s, got:\n%s", unexpected, out)
+		}
+	}
+}
+
+func TestCgroupIsLeafCollector(t *testing.T) {
+	root := t.TempDir()
+	parent := writeCgroup(t, root, "parent.slice", map[string]string{"cgroup.procs": ""})
+	child := writeCgroup(t, parent, "child.service", map[string]string{"cgroup.procs": "1\n"})
+
+	c, err := NewCgroupIsLeafCollector(logger, []string{parent, child})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cgroup_is_leaf{cgroup="parent_slice"} 0`,
+		`cgroupv2_cgroup_is_leaf{cgroup="child_service"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestPressureDisabled(t *testing.T) {
+	psi := "some avg10=0.00 avg60=0.00 avg300=0.00 total=0\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"
+	root := t.TempDir()
+	enabled := writeCgroup(t, root, "enabled", map[string]string{"cgroup.pressure": "1\n", "memory.pressure": psi})
+	disabled := writeCgroup(t, root, "disabled", map[string]string{"cgroup.pressure": "0\n", "memory.pressure": psi})
+
+	state, err := NewCgroupPressureCollector(logger, []string{enabled, disabled})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(state)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cgroup_pressure_enabled{cgroup="enabled"} 1`,
+		`cgroupv2_cgroup_pressure_enabled{cgroup="disabled"} 0`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	c, err := NewMemoryPressureCollector(logger, []string{enabled, disabled})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err = scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroup="enabled"`) {
+		t.Errorf("Expected PSI of the enabled cgroup, got:\n%s", out)
+	}
+	if strings.Contains(out, `cgroup="disabled"`) {
+		t.Errorf("Expected PSI of the disabled cgroup to be skipped, got:\n%s", out)
+	}
+
+	c, err = NewMemoryPressureCollector(logger, []string{disabled})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !errors.Is(err, ErrPressureDisabled) || !IsNoDataError(err) {
+		t.Errorf("Expected ErrPressureDisabled, got %v", err)
+	}
+
+	// A hung cgroup.pressure is bounded by --collector.file-timeout.
+	hung := writeCgroup(t, root, "hung", map[string]string{"memory.pressure": psi})
+	fifo := filepath.Join(hung, "cgroup.pressure")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatalf("Error creating FIFO: %v", err)
+	}
+	defer func() {
+		if f, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+			f.Close()
+		}
+	}()
+	*fileTimeout = 50 * time.Millisecond
+	defer func() { *fileTimeout = 0 }()
+
+	c, err = NewMemoryPressureCollector(logger, []string{hung})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	done := make(chan string)
+	go func() {
+		out, _ := scrape(c)
+		done <- out
+	}()
+	select {
+	case out := <-done:
+		if !strings.Contains(out, `cgroup="hung"`) {
+			t.Errorf("Expected PSI of the cgroup with a hung cgroup.pressure, got:\n%s", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a hung cgroup.pressure not to stall the PSI collector")
+	}
+}
+
+func TestZeroFill(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "swap", map[string]string{"memory.swap.current": "512\n"}),
+		writeCgroup(t, root, "noswap", nil),
+	}
+
+	current, err := NewMemorySwapCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	high, err := NewMemoryHighCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	out, _ := scrape(current)
+	if strings.Contains(out, `cgroup="noswap"`) {
+		t.Errorf("Expected no series for missing file without --collector.zero-fill, got:\n%s", out)
+	}
+
+	*zeroFill = true
+	defer func() { *zeroFill = false }()
+
+	out, err = scrape(current)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_swap_current{cgroup="noswap"} 0`) {
+		t.Errorf("Expected zero-filled series, got:\n%s", out)
+	}
+	if !strings.Contains(out, `cgroupv2_memory_swap_current{cgroup="swap"} 512`) {
+		t.Errorf("Expected real value to be kept, got:\n%s", out)
+	}
+
+	// Limits must never be zero-filled, 0 would read as "no memory allowed".
+	out, _ = scrape(high)
+	if out != "" {
+		t.Errorf("Expected memory.high not to be zero-filled, got:\n%s", out)
+	}
+}
+
+func TestIrqPressureCollector(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "app", map[string]string{"irq.pressure": "full avg10=1.50 avg60=0.75 avg300=0.10 total=98765\n"}),
+	}
+
+	c, err := NewIrqPressureCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	ms := metrics.NewSet()
+	if err := c.Update(ms); err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+
+	if v := ms.GetOrCreateGauge(`cgroupv2_irq_pressure_avg10{cgroup="app",type="full"}`, nil).Get(); v != 1.5 {
+		t.Errorf("Expected avg10 gauge 1.5, got %f", v)
+	}
+	if v := ms.GetOrCreateFloatCounter(`cgroupv2_irq_pressure_total{cgroup="app",type="full"}`).Get(); v != 98765 {
+		t.Errorf("Expected total counter 98765, got %f", v)
+	}
+
+	c, err = NewIrqPressureCollector(logger, []string{writeCgroup(t, root, "old-kernel", nil)})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !IsNoDataError(err) {
+		t.Errorf("Expected ErrNoData without irq.pressure, got %v", err)
+	}
+}
+
+func TestUpdateErrorTypes(t *testing.T) {
+	root := t.TempDir()
+	ok := writeCgroup(t, root, "ok", map[string]string{"memory.current": "1\n"})
+	garbage := writeCgroup(t, root, "garbage", map[string]string{"memory.current": "lots\n"})
+	denied := writeCgroup(t, root, "denied", map[string]string{"memory.current": "1\n"})
+	empty := writeCgroup(t, root, "empty", nil)
+
+	// Tests usually run as root, so permissions can't be denied via chmod.
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		if filepath.Dir(name) == denied {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+		}
+		return os.Open(name)
+	}
+
+	tests := []struct {
+		name     string
+		cgroups  []string
+		expected []error
+	}{
+		{"missing", []string{empty}, []error{ErrFileMissing, ErrNoData}},
+		{"parse", []string{ok, garbage}, []error{ErrParse}},
+		{"permission", []string{ok, denied}, []error{ErrPermission}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewMemoryCurrentCollector(logger, tt.cgroups)
+			if err != nil {
+				t.Fatalf("Error creating collector: %v", err)
+			}
+			_, err = scrape(c)
+			for _, expected := range tt.expected {
+				if !errors.Is(err, expected) {
+					t.Errorf("Expected errors.Is(%v, %v)", err, expected)
+				}
+			}
+		})
+	}
+
+	c, err := NewMemoryCurrentCollector(logger, []string{ok, denied, garbage})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	ms := metrics.NewSet()
+	execute(ms, "test.errors", c, logger, breakers)
+	for _, typ := range []string{"permission", "parse"} {
+		id := `cgroupv2_scrape_collector_errors_total{collector="test.errors",type="` + typ + `"}`
+		if v := ms.GetOrCreateFloatCounter(id).Get(); v != 1 {
+			t.Errorf("Expected %s to be 1, got %f", id, v)
+		}
+	}
+}
+
+func TestPermissionDeniedReportedOnce(t *testing.T) {
+	root := t.TempDir()
+	ok := writeCgroup(t, root, "ok", map[string]string{"memory.current": "1\n"})
+	denied := writeCgroup(t, root, "denied", map[string]string{"memory.current": "1\n"})
+
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		if filepath.Dir(name) == denied {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+		}
+		return os.Open(name)
+	}
+
+	var logs bytes.Buffer
+	c, err := NewMemoryCurrentCollector(slog.New(slog.NewTextHandler(&logs, nil)), []string{ok, denied})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	id := `cgroupv2_collector_permission_denied{cgroup="denied",collector="memory.current"} 1`
+	for i := range 3 {
+		out, err := scrape(c)
+		if i == 0 && !errors.Is(err, ErrPermission) {
+			t.Errorf("Expected ErrPermission on the first scrape, got %v", err)
+		}
+		if i > 0 && err != nil {
+			t.Errorf("Expected no error on repeated scrape %d, got %v", i, err)
+		}
+		if !strings.Contains(out, id) {
+			t.Errorf("Expected %s on scrape %d, got:\n%s", id, i, out)
+		}
+		if strings.Contains(out, `collector_permission_denied{cgroup="ok"`) {
+			t.Errorf("Expected no permission_denied series for a readable cgroup, got:\n%s", out)
+		}
+	}
+	if n := strings.Count(logs.String(), "level=WARN"); n != 1 {
+		t.Errorf("Expected a single warning, got %d:\n%s", n, logs.String())
+	}
+}
+
+// errReader fails every read with err, like files of a non-functional controller.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+func (r errReader) Close() error             { return nil }
+
+func TestRawOnParseFailure(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "ok", map[string]string{"memory.current": "100\n"}),
+		writeCgroup(t, root, "garbled", map[string]string{"memory.current": "100 bytes, roughly\n"}),
+	}
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	out, err := scrape(c)
+	if !errors.Is(err, ErrParse) {
+		t.Errorf("Expected ErrParse, got %v", err)
+	}
+	if strings.Contains(out, "cgroupv2_raw_file") {
+		t.Errorf("Expected no raw file series by default, got:\n%s", out)
+	}
+
+	*rawOnParseFailure = true
+	defer func() { *rawOnParseFailure = false }()
+	out, err = scrape(c)
+	if !errors.Is(err, ErrParse) {
+		t.Errorf("Expected ErrParse, got %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_raw_file{cgroup="garbled",file="memory.current"} 1`,
+		`cgroupv2_memory_current{cgroup="ok"} 100`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, `cgroupv2_raw_file{cgroup="ok"`) {
+		t.Errorf("Expected no raw file series for a parsed file, got:\n%s", out)
+	}
+
+	// Key-value files skip malformed lines, but one without any valid line
+	// is reported, unlike a file that fails to read.
+	stats := []string{
+		writeCgroup(t, root, "garbledstat", map[string]string{"memory.stat": "anon: 4 KiB\nfile: 8 KiB\n"}),
+		writeCgroup(t, root, "unreadable", map[string]string{"memory.stat": "anon 4096\n"}),
+	}
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		if filepath.Base(filepath.Dir(name)) == "unreadable" {
+			return errReader{&os.PathError{Op: "read", Path: name, Err: syscall.EIO}}, nil
+		}
+		return os.Open(name)
+	}
+	c, err = NewMemoryStatCollector(logger, stats)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err = scrape(c)
+	if !errors.Is(err, ErrParse) || !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected ErrParse and EIO, got %v", err)
+	}
+	if expected := `cgroupv2_raw_file{cgroup="garbledstat",file="memory.stat"} 1`; !strings.Contains(out, expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, out)
+	}
+	if strings.Contains(out, `cgroupv2_raw_file{cgroup="unreadable"`) {
+		t.Errorf("Expected no raw file series for a read error, got:\n%s", out)
+	}
+}
+
+func TestUnsupportedRead(t *testing.T) {
+	root := t.TempDir()
+	ok := writeCgroup(t, root, "ok", map[string]string{"memory.stat": "anon 1\n"})
+	unsupported := writeCgroup(t, root, "unsupported", map[string]string{"memory.stat": "anon 1\n"})
+
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		if filepath.Dir(name) == unsupported {
+			return errReader{&os.PathError{Op: "read", Path: name, Err: syscall.EOPNOTSUPP}}, nil
+		}
+		return os.Open(name)
+	}
+
+	c, err := NewMemoryStatCollector(logger, []string{ok, unsupported})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Errorf("Expected an unsupported cgroup to be skipped without error, got %v", err)
+	}
+	if !strings.Contains(out, `cgroup="ok"`) {
+		t.Errorf("Expected series of the readable cgroup, got:\n%s", out)
+	}
+	if strings.Contains(out, `cgroup="unsupported"`) {
+		t.Errorf("Expected no series of the unsupported cgroup, got:\n%s", out)
+	}
+
+	c, err = NewMemoryStatCollector(logger, []string{unsupported})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	if _, err := scrape(c); !errors.Is(err, ErrUnsupported) || !IsNoDataError(err) {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
+
+// fakeClock advances by step on every reading.
+type fakeClock struct {
+	mtx  sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func TestScrapeDuration(t *testing.T) {
+	root := t.TempDir()
+	c, err := NewMemoryCurrentCollector(logger, []string{writeCgroup(t, root, "app", map[string]string{"memory.current": "1\n"})})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	defer func(orig clock) { scrapeClock = orig }(scrapeClock)
+	scrapeClock = &fakeClock{now: time.Unix(0, 0), step: 1500 * time.Millisecond}
+
+	ms := metrics.NewSet()
+	execute(ms, "memory.current", c, logger, breakers)
+	id := `cgroupv2_scrape_collector_duration_seconds{collector="memory.current"}`
+	if v := ms.GetOrCreateGauge(id, nil).Get(); v != 1.5 {
+		t.Errorf("Expected %s to be 1.5, got %f", id, v)
+	}
+}
+
+func TestCompactScrapeMetrics(t *testing.T) {
+	*compactScrapeMetrics = true
+	defer func() { *compactScrapeMetrics = false }()
+
+	defer func(orig clock) { scrapeClock = orig }(scrapeClock)
+	scrapeClock = &fakeClock{now: time.Unix(0, 0), step: 500 * time.Millisecond}
+
+	ms := metrics.NewSet()
+	execute(ms, "test.ok", &flakyCollector{}, logger, breakers)
+	execute(ms, "test.failing", &flakyCollector{err: errors.New("boom")}, logger, breakers)
+	var b bytes.Buffer
+	ms.WritePrometheus(&b)
+	out := b.String()
+	for _, expected := range []string{
+		`cgroupv2_scrape_collector_duration_seconds{collector="test.ok",success="true"} 0.5`,
+		`cgroupv2_scrape_collector_duration_seconds{collector="test.failing",success="false"} 0.5`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "cgroupv2_scrape_collector_success") {
+		t.Errorf("Expected no scrape_collector_success series in compact mode, got:\n%s", out)
+	}
+}
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	root := t.TempDir()
+	dir := writeCgroup(t, root, "app", map[string]string{"memory.current": "1\n"})
+	c, err := NewMemoryCurrentCollector(logger, []string{dir})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+
+	defer func(orig clock) { scrapeClock = orig }(scrapeClock)
+	scrapeClock = &fakeClock{now: time.Unix(1000, 0), step: 10 * time.Second}
+	id := `cgroupv2_collector_last_success_timestamp_seconds{collector="test.last_success"}`
+
+	ms := metrics.NewSet()
+	execute(ms, "test.last_success", c, logger, breakers)
+	if v := ms.GetOrCreateGauge(id, nil).Get(); v != 1000 {
+		t.Errorf("Expected %s to be 1000, got %f", id, v)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "memory.current"), []byte("garbage\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ms = metrics.NewSet()
+	execute(ms, "test.last_success", c, logger, breakers)
+	if v := ms.GetOrCreateGauge(`cgroupv2_scrape_collector_success{collector="test.last_success"}`, nil).Get(); v != 0 {
+		t.Fatalf("Expected the second scrape to fail, got success %f", v)
+	}
+	if v := ms.GetOrCreateGauge(id, nil).Get(); v != 1000 {
+		t.Errorf("Expected %s to stay at the last success 1000, got %f", id, v)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.current": "1\n", "pids.current": "2\n"})}
+
+	var reads atomic.Int32
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		reads.Add(1)
+		return os.Open(name)
+	}
+	fc := &fakeClock{now: time.Unix(0, 0)}
+	defer func(orig clock) { scrapeClock = orig }(scrapeClock)
+	scrapeClock = fc
+	*cacheTTL = 10 * time.Second
+	defer func() { *cacheTTL = 0 }()
+
+	memory, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	pids, err := NewPidsCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	// Like the unfiltered and a collect[] filtered handler, sharing the cached collectors.
+	unfiltered := &Cgroup2Collector{Collectors: map[string]Collector{"memory.current": memory, "pids.current": pids}, logger: logger}
+	filtered := &Cgroup2Collector{Collectors: map[string]Collector{"memory.current": memory}, logger: logger}
+
+	var wg sync.WaitGroup
+	for _, cgc := range []*Cgroup2Collector{unfiltered, filtered, unfiltered} {
+		wg.Go(func() { cgc.Scrape(metrics.NewSet()) })
+	}
+	wg.Wait()
+	if n := reads.Load(); n != 2 {
+		t.Errorf("Expected overlapping scrapes to read each file once, got %d reads", n)
+	}
+	reads.Store(0)
+	filtered.Scrape(metrics.NewSet())
+	unfiltered.Scrape(metrics.NewSet())
+	if n := reads.Load(); n != 0 {
+		t.Errorf("Expected no reads within the TTL, got %d", n)
+	}
+
+	fc.now = fc.now.Add(11 * time.Second)
+	ms := metrics.NewSet()
+	filtered.Scrape(ms)
+	if n := reads.Load(); n != 1 {
+		t.Errorf("Expected the filtered collector to be read again after the TTL, got %d reads", n)
+	}
+	if v := ms.GetOrCreateGauge(`cgroupv2_memory_current{cgroup="app"}`, nil).Get(); v != 1 {
+		t.Errorf("Expected memory.current 1, got %f", v)
+	}
+
+	// Reads of a removed cgroup expire and are dropped.
+	gone := writeCgroup(t, root, "gone", map[string]string{"memory.current": "3\n"})
+	fc.now = fc.now.Add(11 * time.Second)
+	mc := memory.(*Cgroupv2FileCollector)
+	mc.dirNames = []string{cgroups[0], gone}
+	filtered.Scrape(metrics.NewSet())
+	mc.dirNames = cgroups
+	fc.now = fc.now.Add(11 * time.Second)
+	filtered.Scrape(metrics.NewSet())
+	if _, ok := mc.reads[filepath.Join(gone, "memory.current")]; ok || len(mc.reads) != 1 {
+		t.Errorf("Expected the expired read of the removed cgroup to be dropped, got %v", mc.reads)
+	}
+}
+
+func TestCacheConcurrentMisses(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{"memory.current": "1\n"})}
+
+	var reads atomic.Int32
+	release := make(chan struct{})
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		reads.Add(1)
+		<-release
+		return os.Open(name)
+	}
+	*cacheTTL = 10 * time.Second
+	defer func() { *cacheTTL = 0 }()
+
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() { c.Update(metrics.NewSet()) })
+	}
+	// Let the first read block until all scrapes have missed the cache.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := reads.Load(); n != 1 {
+		t.Errorf("Expected concurrent misses to share one read, got %d reads", n)
+	}
+}
+
+func TestFileTimeout(t *testing.T) {
+	root := t.TempDir()
+	fast := writeCgroup(t, root, "fast", map[string]string{"memory.current": "10\n"})
+	slow := writeCgroup(t, root, "slow", nil)
+	other := writeCgroup(t, root, "other", map[string]string{"memory.current": "20\n"})
+
+	// Opening a FIFO for reading blocks until a writer shows up, like a hung read.
+	fifo := filepath.Join(slow, "memory.current")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatalf("Error creating FIFO: %v", err)
+	}
+	defer func() {
+		// Unblock the abandoned reader.
+		if f, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+			f.Close()
+		}
+	}()
+
+	*fileTimeout = 50 * time.Millisecond
+	defer func() { *fileTimeout = 0 }()
+
+	c, err := NewMemoryCurrentCollector(logger, []string{fast, slow, other})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Expected a timed out cgroup not to fail the collector, got %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="fast"} 10`,
+		`cgroupv2_memory_current{cgroup="other"} 20`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, `cgroup="slow"`) {
+		t.Errorf("Expected the slow cgroup to be skipped, got:\n%s", out)
+	}
+}
+
+func TestUserSlicePermissionDenied(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "system.slice/a.service", map[string]string{"memory.current": "100\n"}),
+		writeCgroup(t, root, "user.slice/user-1000.slice/user@1000.service", map[string]string{"memory.current": "200\n"}),
+		writeCgroup(t, root, "user.slice/user-1000.slice/session-1.scope", map[string]string{"memory.current": "300\n"}),
+	}
+	defer func(orig func(string) (io.ReadCloser, error)) { openFile = orig }(openFile)
+	openFile = func(name string) (io.ReadCloser, error) {
+		if strings.Contains(name, "/user.slice/") {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+		}
+		return os.Open(name)
+	}
+
+	id := `cgroupv2_scrape_cgroups_skipped_total{reason="user_slice_permission"}`
+	count := func() float64 {
+		ms := metrics.NewSet()
+		skippedCgroups.writeTo(ms)
+		return ms.GetOrCreateFloatCounter(id).Get()
+	}
+	before := count()
+
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	cgc := &Cgroup2Collector{Collectors: map[string]Collector{"memory.current": c}, logger: logger}
+	ms := metrics.NewSet()
+	cgc.Scrape(ms)
+
+	if v := ms.GetOrCreateFloatCounter(id).Get(); v != before+2 {
+		t.Errorf("Expected %s to be %f, got %f", id, before+2, v)
+	}
+	var buf bytes.Buffer
+	ms.WritePrometheus(&buf)
+	out := buf.String()
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="a_service"} 100`,
+		`cgroupv2_collector_permission_denied{cgroup="user_1000_service",collector="memory.current"} 1`,
+		`cgroupv2_collector_permission_denied{cgroup="session_1_scope",collector="memory.current"} 1`,
+		`cgroupv2_scrape_collector_success{collector="memory.current"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestSkippedCgroupsCounter(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "present", map[string]string{"pids.current": "3\n"}),
+		writeCgroup(t, root, "absent", nil),
+	}
+	id := `cgroupv2_scrape_cgroups_skipped_total{reason="missing_file"}`
+	count := func() float64 {
+		ms := metrics.NewSet()
+		skippedCgroups.writeTo(ms)
+		return ms.GetOrCreateFloatCounter(id).Get()
+	}
+	before := count()
+
+	c, err := NewPidsCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	cgc := &Cgroup2Collector{Collectors: map[string]Collector{"pids.current": c}, logger: logger}
+	ms := metrics.NewSet()
+	cgc.Scrape(ms)
+
+	if v := ms.GetOrCreateFloatCounter(id).Get(); v != before+1 {
+		t.Errorf("Expected %s to be %f, got %f", id, before+1, v)
+	}
+}
+
+func TestSkipDisabledControllers(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "withio", map[string]string{
+			"cgroup.controllers": "cpu io memory pids\n",
+			"io.stat":            "8:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+			"io.pressure":        "some avg10=0.00 avg60=0.00 avg300=0.00 total=1\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=1\n",
+		}),
+		writeCgroup(t, root, "withoutio", map[string]string{
+			"cgroup.controllers": "cpu memory pids\n",
+			"io.pressure":        "some avg10=0.00 avg60=0.00 avg300=0.00 total=2\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=2\n",
+		}),
+	}
+	id := `cgroupv2_scrape_cgroups_skipped_total{reason="missing_file"}`
+	count := func() float64 {
+		ms := metrics.NewSet()
+		skippedCgroups.writeTo(ms)
+		return ms.GetOrCreateFloatCounter(id).Get()
+	}
+
+	*skipDisabledControllers = true
+	defer func() { *skipDisabledControllers = false }()
+	for _, name := range []string{"io.stat", "io.pressure"} {
+		enabled := collectorState[name]
+		defer func(state bool) { *enabled = state }(*enabled)
+		*enabled = true
+	}
+
+	cgc, err := NewCgroupv2SubsetCollector(cgroups, logger, "io.stat", "io.pressure")
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	before := count()
+	out, err := scrape(cgc.Collectors["io.stat"])
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if strings.Contains(out, `cgroup="withoutio"`) {
+		t.Errorf("Expected cgroup without the io controller to be skipped, got:\n%s", out)
+	}
+	if !strings.Contains(out, `cgroupv2_io_stat_rbytes{cgroup="withio",device="8:0"} 1024`) {
+		t.Errorf("Expected io.stat of cgroup with the io controller, got:\n%s", out)
+	}
+	if v := count(); v != before {
+		t.Errorf("Expected no missing file to be counted, got %f more", v-before)
+	}
+
+	// Pressure files exist regardless of the enabled controllers.
+	out, err = scrape(cgc.Collectors["io.pressure"])
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	if !strings.Contains(out, `cgroup="withoutio"`) {
+		t.Errorf("Expected io.pressure not to be pruned, got:\n%s", out)
+	}
+}
+
+func BenchmarkMemoryStatUpdate(b *testing.B) {
+	var stat strings.Builder
+	for _, key := range []string{
+		"anon", "file", "kernel", "kernel_stack", "pagetables", "sec_pagetables", "percpu", "sock", "vmalloc",
+		"shmem", "zswap", "zswapped", "file_mapped", "file_dirty", "file_writeback", "swapcached", "anon_thp",
+		"file_thp", "shmem_thp", "inactive_anon", "active_anon", "inactive_file", "active_file", "unevictable",
+		"slab_reclaimable", "slab_unreclaimable", "slab", "workingset_refault_anon", "workingset_refault_file",
+		"workingset_activate_anon", "workingset_activate_file", "workingset_restore_anon", "workingset_restore_file",
+		"workingset_nodereclaim", "pgscan", "pgsteal", "pgfault", "pgmajfault", "pgrefill", "pgactivate",
+	} {
+		stat.WriteString(key + " 123456\n")
+	}
+
+	root := b.TempDir()
+	cgroups := make([]string, 0, 100)
+	for i := 0; i < cap(cgroups); i++ {
+		dir := filepath.Join(root, "app-"+strconv.Itoa(i)+".service")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "memory.stat"), []byte(stat.String()), 0o644); err != nil {
+			b.Fatal(err)
+		}
+		cgroups = append(cgroups, dir)
+	}
+
+	c, err := NewMemoryStatCollector(promslog.NewNopLogger(), cgroups)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Update(metrics.NewSet()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// conflictingCollector exports the same series once as a gauge and once as a counter.
+type conflictingCollector struct{}
+
+func (conflictingCollector) Update(metricSet *metrics.Set) error {
+	metricSet.GetOrCreateGauge(`cgroupv2_conflict{cgroup="a"}`, nil).Set(1)
+	metricSet.GetOrCreateFloatCounter(`cgroupv2_conflict{cgroup="a"}`).Set(1)
+	return nil
+}
+
+func TestConflictingMetricTypesFailCollector(t *testing.T) {
+	ms := metrics.NewSet()
+	execute(ms, "conflict", conflictingCollector{}, logger, breakers)
+
+	if v := ms.GetOrCreateGauge(`cgroupv2_scrape_collector_success{collector="conflict"}`, nil).Get(); v != 0 {
+		t.Errorf("Expected conflicting metric types to fail the collector, got success=%f", v)
+	}
+}
+
+// flakyCollector fails with err, if set, and counts its runs.
+type flakyCollector struct {
+	runs int
+	err  error
+}
+
+func (fc *flakyCollector) Update(metricSet *metrics.Set) error {
+	fc.runs++
+	return fc.err
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(failures int, retry time.Duration) {
+		*breakerFailures, *breakerRetryInterval = failures, retry
+	}(*breakerFailures, *breakerRetryInterval)
+	*breakerFailures, *breakerRetryInterval = 3, time.Minute
+
+	defer func(orig clock) { scrapeClock = orig }(scrapeClock)
+	fc := &fakeClock{now: time.Unix(1000, 0)}
+	scrapeClock = fc
+
+	c := &flakyCollector{err: ErrFileMissing}
+	id := `cgroupv2_collector_circuit_open{collector="test.breaker"}`
+	run := func() float64 {
+		ms := metrics.NewSet()
+		execute(ms, "test.breaker", c, logger, breakers)
+		fc.now = fc.now.Add(10 * time.Second)
+		return ms.GetOrCreateGauge(id, nil).Get()
+	}
+
+	for i := range 2 {
+		if open := run(); open != 0 {
+			t.Errorf("Expected the circuit closed after %d failures, got %f", i+1, open)
+		}
+	}
+	if open := run(); open != 1 {
+		t.Errorf("Expected the circuit open after 3 failures, got %f", open)
+	}
+	ms := metrics.NewSet()
+	execute(ms, "test.breaker", c, logger, breakers)
+	if open := ms.GetOrCreateGauge(id, nil).Get(); open != 1 || c.runs != 3 {
+		t.Errorf("Expected the open circuit to skip the collector, got open %f after %d runs", open, c.runs)
+	}
+	var b bytes.Buffer
+	ms.WritePrometheus(&b)
+	if expected := `cgroupv2_scrape_collector_success{collector="test.breaker"} 0`; !strings.Contains(b.String(), expected) {
+		t.Errorf("Expected %s while the circuit is open, got:\n%s", expected, b.String())
+	}
+
+	// After the retry interval the collector runs again and closes the circuit.
+	fc.now = fc.now.Add(time.Minute)
+	c.err = nil
+	if open := run(); open != 0 || c.runs != 4 {
+		t.Errorf("Expected a successful retry to close the circuit, got open %f after %d runs", open, c.runs)
+	}
+
+	// Failures of scrapes of a subset of the cgroups don't pause the collector.
+	c.err = ErrFileMissing
+	subset := &Cgroup2Collector{Collectors: map[string]Collector{"test.breaker": c}, logger: logger, subset: true}
+	for range 5 {
+		subset.Scrape(metrics.NewSet())
+	}
+	if open := run(); open != 0 || c.runs != 10 {
+		t.Errorf("Expected subset scrapes not to open the circuit, got open %f after %d runs", open, c.runs)
+	}
+}
+
+func TestCounterFollowsKernelValueAfterReset(t *testing.T) {
+	root := t.TempDir()
+	cgroup := writeCgroup(t, root, "app", map[string]string{"cpu.stat": "usage_usec 5000\n"})
+
+	c, err := NewCpuStatCollector(logger, []string{cgroup})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	id := `cgroupv2_cpu_stat{cgroup="app",stat="usage_usec"}`
+
+	for _, value := range []string{"5000", "120", "180"} {
+		// The cgroup got recreated under the same path between scrapes, resetting the counter.
+		writeCgroup(t, root, "app", map[string]string{"cpu.stat": "usage_usec " + value + "\n"})
+
+		ms := metrics.NewSet()
+		if err := c.Update(ms); err != nil {
+			t.Fatalf("Error calling Update: %v", err)
+		}
+		expected, _ := strconv.ParseFloat(value, 64)
+		if v := ms.GetOrCreateFloatCounter(id).Get(); v != expected {
+			t.Errorf("Expected counter to follow the kernel value %f, got %f", expected, v)
+		}
+	}
+}
+
+func TestReadRuntimeInfo(t *testing.T) {
+	defer func(orig func() (string, error)) { kernelRelease = orig }(kernelRelease)
+	kernelRelease = func() (string, error) { return "6.8.0-test", nil }
+
+	for _, tc := range []struct {
+		name      string
+		mountinfo string
+		expected  string
+	}{
+		{
+			name: "unified",
+			mountinfo: "22 28 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw\n" +
+				"31 26 0:26 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:9 - cgroup2 cgroup2 rw,nsdelegate\n",
+			expected: `cgroupv2_exporter_runtime_info{cgroup_mount="/sys/fs/cgroup",kernel="6.8.0-test",unified="true"}`,
+		},
+		{
+			name: "hybrid",
+			mountinfo: "30 26 0:25 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755\n" +
+				"31 30 0:26 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw\n" +
+				"32 30 0:27 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,memory\n",
+			expected: `cgroupv2_exporter_runtime_info{cgroup_mount="/sys/fs/cgroup/unified",kernel="6.8.0-test",unified="false"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			procfs := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(procfs, "self"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(procfs, "self", "mountinfo"), []byte(tc.mountinfo), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			info, err := ReadRuntimeInfo(procfs)
+			if err != nil {
+				t.Fatalf("Error reading runtime info: %v", err)
+			}
+			if got := RuntimeInfoMetric(info); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestGoldenOutput guards the exposition of a fixture cgroup tree, which must be
+// byte-stable: series are sorted by name and labels by formatMetricID.
+// Regenerate the golden file with go test -run TestGoldenOutput -update.
+func TestGoldenOutput(t *testing.T) {
+	cgroups := []string{
+		filepath.Join("testdata", "cgroupfs", "system.slice", "a.service"),
+		filepath.Join("testdata", "cgroupfs", "system.slice", "b.service"),
+	}
+	cgc, err := NewRegistry(RegistryOpts{
+		Cgroups: cgroups,
+		Collectors: []string{
+			"cgroup.is_leaf", "cgroup.pressure", "cpu.pressure", "cpu.stat", "io.stat", "memory.current",
+			"memory.high", "memory.pressure", "memory.stat", "memory.utilization", "pids.current",
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		t.Fatalf("Error creating registry: %v", err)
+	}
+
+	var outputs []string
+	for range 3 {
+		ms := metrics.NewSet()
+		for name, c := range cgc.Collectors {
+			if err := c.Update(ms); err != nil && !IsNoDataError(err) {
+				t.Fatalf("Error updating %s: %v", name, err)
+			}
+		}
+		var b bytes.Buffer
+		ms.WritePrometheus(&b)
+		outputs = append(outputs, b.String())
+	}
+	for i, out := range outputs[1:] {
+		if out != outputs[0] {
+			t.Errorf("Expected identical output on every scrape, scrape %d differs:\n%s", i+1, out)
+		}
+	}
+
+	golden := filepath.Join("testdata", "golden.prom")
+	if *updateGolden {
+		if err := os.WriteFile(golden, []byte(outputs[0]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Error reading golden file: %v", err)
+	}
+	if outputs[0] != string(expected) {
+		t.Errorf("Expected output of %s, got:\n%s", golden, outputs[0])
+	}
+}
+
+func TestGather(t *testing.T) {
+	cgc, err := NewRegistry(RegistryOpts{
+		Cgroups:    []string{filepath.Join("testdata", "cgroupfs", "system.slice", "a.service")},
+		Collectors: []string{"memory.current", "cpu.stat"},
+		Logger:     logger,
+	})
+	if err != nil {
+		t.Fatalf("Error creating registry: %v", err)
+	}
+	var gatherer prometheus.Gatherer = cgc
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering: %v", err)
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for i, mf := range families {
+		if i > 0 && families[i-1].GetName() >= mf.GetName() {
+			t.Errorf("Expected families sorted by name, got %s before %s", families[i-1].GetName(), mf.GetName())
+		}
+		byName[mf.GetName()] = mf
+	}
+	memory := byName["cgroupv2_memory_current"]
+	if memory == nil || len(memory.GetMetric()) != 1 {
+		t.Fatalf("Expected one cgroupv2_memory_current metric, got %v", memory)
+	}
+	if v := memory.GetMetric()[0].GetUntyped().GetValue(); v != 104857600 {
+		t.Errorf("Expected memory.current 104857600, got %f", v)
+	}
+	if n := len(byName["cgroupv2_cpu_stat"].GetMetric()); n != 6 {
+		t.Errorf("Expected 6 cpu.stat metrics, got %d", n)
+	}
+	if byName["cgroupv2_scrape_collector_success"] == nil {
+		t.Errorf("Expected the scrape metrics of the collectors, got %v", slices.Collect(maps.Keys(byName)))
+	}
+}
@@ -2,13 +2,15 @@ package collector
 
 import (
 	"log/slog"
+	"strings"
 
 	"github.com/asama-ai/cgroupv2_exporter/parsers"
 )
 
 func NewCpuStatCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "cpu.stat"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
+	typeOf := cgroupTypeReader(logger)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.FlatKeyValueParser{
@@ -20,28 +22,93 @@ func NewCpuStatCollector(logger *slog.Logger, cgroups []string) (Collector, erro
 		logger:   fileLogger,
 		// Cumulative kernel counters; FloatCounter.Set publishes the absolute value each scrape.
 		isCounter: func(metricName string, labels map[string]string) bool { return true },
+		// Threaded cgroups, the members of a threaded subtree below a "domain
+		// threaded" cgroup, are labelled threaded="true". The series of all
+		// other cgroups are left as they are.
+		cgroupLabels: func(dirName string) map[string]string {
+			if typeOf(dirName) == "threaded" {
+				return map[string]string{"threaded": "true"}
+			}
+			return nil
+		},
 	}, nil
 }
 
 func NewCpuPressureCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "cpu.pressure"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.NestedKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			PrefixInName: *psiLayout == layoutName,
+		},
+		dirNames:        cgroups,
+		fileName:        file,
+		logger:          fileLogger,
+		isCounter:       isPressureTotalField,
+		stallHistogram:  true,
+		pressureEnabled: pressureEnabledReader(logger),
+		extraMetrics:    cpuPressureFullAvailable,
+	}, nil
+}
+
+// cpuPressureFullAvailable reports whether cpu.pressure has a "full" line, which
+// kernels before 5.13 omit for CPU. A missing line is not synthesized.
+func cpuPressureFullAvailable(metricsFromFile []parsers.Metric) []parsers.Metric {
+	available := 0.0
+	for _, m := range metricsFromFile {
+		if m.Labels["type"] == "full" || strings.HasPrefix(m.Name, "cpu_pressure_full_") {
+			available = 1
+			break
+		}
+	}
+	return []parsers.Metric{{Name: "cpu_pressure_full_available", Value: available, Labels: map[string]string{}}}
+}
+
+// NewIrqPressureCollector reports time stalled on IRQ/softirq processing. The kernel
+// only exposes the "full" line for this resource.
+func NewIrqPressureCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "irq.pressure"
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.NestedKeyValueParser{
 			MetricPrefix: sanitizeP8sName(file),
 			Logger:       fileLogger,
+			PrefixInName: *psiLayout == layoutName,
+		},
+		dirNames:        cgroups,
+		fileName:        file,
+		logger:          fileLogger,
+		isCounter:       isPressureTotalField,
+		stallHistogram:  true,
+		pressureEnabled: pressureEnabledReader(logger),
+	}, nil
+}
+
+// NewCpuIdleCollector reports whether the cgroup is idle-scheduled
+// (SCHED_IDLE, 1) or not (0), on Linux 5.15+.
+func NewCpuIdleCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cpu.idle"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
 		},
 		dirNames:  cgroups,
 		fileName:  file,
 		logger:    fileLogger,
-		isCounter: func(metricName string, _ map[string]string) bool { return isPressureTotalField(metricName) },
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
 	}, nil
 }
 
 func NewCPUSetCpusCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "cpuset.cpus"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.RangeListCountParser{
@@ -57,7 +124,7 @@ func NewCPUSetCpusCollector(logger *slog.Logger, cgroups []string) (Collector, e
 
 func NewCPUSetCpusEffectiveCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "cpuset.cpus.effective"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.RangeListCountParser{
@@ -71,9 +138,28 @@ func NewCPUSetCpusEffectiveCollector(logger *slog.Logger, cgroups []string) (Col
 	}, nil
 }
 
+// NewCPUSetPartitionCollector reports the partition state of the cpuset, e.g.
+// member, root, isolated or root invalid, as the state label of an info metric.
+func NewCPUSetPartitionCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cpuset.cpus.partition"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.StateParser{
+			MetricPrefix: "cpuset_partition",
+			Logger:       fileLogger,
+			LabelName:    "state",
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
 func NewCPUSetMemsCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "cpuset.mems"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.RangeListCountParser{
@@ -89,7 +175,7 @@ func NewCPUSetMemsCollector(logger *slog.Logger, cgroups []string) (Collector, e
 
 func NewCPUSetMemsEffectiveCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "cpuset.mems.effective"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.RangeListCountParser{
@@ -102,3 +188,22 @@ func NewCPUSetMemsEffectiveCollector(logger *slog.Logger, cgroups []string) (Col
 		isCounter: func(metricName string, labels map[string]string) bool { return false },
 	}, nil
 }
+
+// NewCpuStatLocalCollector reports cpu.stat.local, the throttling time of the
+// cgroup itself rather than caused by its ancestors (Linux 6.8+). The root
+// cgroup has no such file.
+func NewCpuStatLocalCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "cpu.stat.local"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.FlatKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return true },
+	}, nil
+}
@@ -0,0 +1,222 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"path/filepath"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/asama-ai/cgroupv2_exporter/parsers"
+)
+
+// derivedCollector emits a metric computed from several single-value interface
+// files of the same cgroup, e.g. a usage/limit ratio. Cgroups lacking any of the
+// files are skipped.
+type derivedCollector struct {
+	metricName string
+	inputs     []*Cgroupv2FileCollector
+	dirNames   []string
+	logger     *slog.Logger
+	// derive computes the metric from the input values keyed by file name. It
+	// returns false when there is nothing meaningful to report.
+	derive func(values map[string]float64) (float64, bool)
+	// unit is the unit label added with --collector.unit-label, if any.
+	unit string
+}
+
+// newDerivedCollector creates a derivedCollector reading fileNames with a
+// SingleValueParser (so "max" reads as +Inf).
+func newDerivedCollector(logger *slog.Logger, cgroups []string, metricName string, fileNames []string, derive func(map[string]float64) (float64, bool)) *derivedCollector {
+	inputs := make([]*Cgroupv2FileCollector, 0, len(fileNames))
+	for _, file := range fileNames {
+		fileLogger := logger.With("file", file)
+		inputs = append(inputs, &Cgroupv2FileCollector{
+			parser: &parsers.SingleValueParser{
+				MetricPrefix: sanitizeP8sName(file),
+				Logger:       fileLogger,
+				ParseUnits:   *parseUnits,
+			},
+			fileName: file,
+			logger:   fileLogger,
+		})
+	}
+	return &derivedCollector{
+		metricName: metricName,
+		inputs:     inputs,
+		dirNames:   cgroups,
+		logger:     logger,
+		derive:     derive,
+	}
+}
+
+func (dc *derivedCollector) checkAvailable(cgroup string) error {
+	for _, in := range dc.inputs {
+		if err := in.checkAvailable(cgroup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dc *derivedCollector) Update(metricSet *metrics.Set) error {
+	var errs []error
+	found := false
+dirs:
+	for _, dirName := range dc.dirNames {
+		values := make(map[string]float64, len(dc.inputs))
+		for _, in := range dc.inputs {
+			metricsFromFile, err := in.readFile(filepath.Join(dirName, in.fileName))
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				dc.logger.Debug("file not found, skipping", "file", in.fileName, "dir", dirName)
+				continue dirs
+			case errors.Is(err, fs.ErrPermission):
+				errs = append(errs, fmt.Errorf("%w: %w", ErrPermission, err))
+				continue dirs
+			case err != nil:
+				errs = append(errs, err)
+				continue dirs
+			case len(metricsFromFile) != 1:
+				continue dirs
+			}
+			values[in.fileName] = metricsFromFile[0].Value
+		}
+		found = true
+
+		v, ok := dc.derive(values)
+		if !ok || math.IsNaN(v) {
+			continue
+		}
+		labels := cgroupBaseLabels(dirName)
+		if *unitLabel && dc.unit != "" {
+			labels["unit"] = dc.unit
+		}
+		id := formatMetricID(joinFQ(dc.metricName), labels)
+		metricSet.GetOrCreateGauge(id, nil).Set(v)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if !found {
+		return ErrFileMissing
+	}
+	return nil
+}
+
+// NewMemoryUtilizationCollector reports memory.current / memory.max. Cgroups
+// without a memory limit are omitted.
+func NewMemoryUtilizationCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	dc := newDerivedCollector(logger, cgroups, "memory_utilization_ratio",
+		[]string{"memory.current", "memory.max"},
+		func(values map[string]float64) (float64, bool) {
+			limit := values["memory.max"]
+			if math.IsInf(limit, 1) || limit <= 0 {
+				return 0, false
+			}
+			return values["memory.current"] / limit, true
+		},
+	)
+	dc.unit = unitRatio
+	return dc, nil
+}
+
+// NewMemoryOverHighCollector reports whether memory.current exceeds
+// memory.high (1) or not (0). Above memory.high the cgroup is throttled and
+// put under reclaim pressure, which memory.events only counts. Cgroups without
+// a finite memory.high are omitted.
+func NewMemoryOverHighCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	return newDerivedCollector(logger, cgroups, "memory_over_high",
+		[]string{"memory.current", "memory.high"},
+		func(values map[string]float64) (float64, bool) {
+			high := values["memory.high"]
+			if math.IsInf(high, 1) {
+				return 0, false
+			}
+			if values["memory.current"] > high {
+				return 1, true
+			}
+			return 0, true
+		},
+	), nil
+}
+
+// sockCollector reports the network socket buffer memory of the sock key of
+// memory.stat and its share of memory.current.
+type sockCollector struct {
+	stat     *Cgroupv2FileCollector
+	current  *Cgroupv2FileCollector
+	dirNames []string
+	logger   *slog.Logger
+}
+
+// NewMemorySockCollector reports memory.stat's sock, the memory used by
+// network socket buffers, as cgroupv2_memory_sock_bytes, and its ratio to
+// memory.current as cgroupv2_memory_sock_ratio for cgroups using memory.
+func NewMemorySockCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	statLogger := logger.With("file", "memory.stat")
+	currentLogger := logger.With("file", "memory.current")
+	return &sockCollector{
+		stat: &Cgroupv2FileCollector{
+			parser:   &parsers.FlatKeyValueParser{MetricPrefix: "memory_stat", Logger: statLogger},
+			fileName: "memory.stat",
+			logger:   statLogger,
+		},
+		current: &Cgroupv2FileCollector{
+			parser:   &parsers.SingleValueParser{MetricPrefix: "memory_current", Logger: currentLogger},
+			fileName: "memory.current",
+			logger:   currentLogger,
+		},
+		dirNames: cgroups,
+		logger:   logger,
+	}, nil
+}
+
+func (sc *sockCollector) checkAvailable(cgroup string) error {
+	// memory.current is only needed for the ratio.
+	return sc.stat.checkAvailable(cgroup)
+}
+
+func (sc *sockCollector) Update(metricSet *metrics.Set) error {
+	var errs []error
+	found := false
+	for _, dirName := range sc.dirNames {
+		statMetrics, err := sc.stat.readFile(filepath.Join(dirName, sc.stat.fileName))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			sc.logger.Debug("file not found, skipping", "file", sc.stat.fileName, "dir", dirName)
+			continue
+		case err != nil:
+			errs = append(errs, err)
+			continue
+		}
+		sock, ok := 0.0, false
+		for _, m := range statMetrics {
+			if m.Labels["stat"] == "sock" {
+				sock, ok = m.Value, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		found = true
+		labels := cgroupBaseLabels(dirName)
+		metricSet.GetOrCreateGauge(formatMetricID(joinFQ("memory_sock_bytes"), labels), nil).Set(sock)
+
+		currentMetrics, err := sc.current.readFile(filepath.Join(dirName, sc.current.fileName))
+		if err != nil || len(currentMetrics) != 1 || currentMetrics[0].Value <= 0 {
+			sc.logger.Debug("no memory.current, omitting sock ratio", "dir", dirName, "err", err)
+			continue
+		}
+		metricSet.GetOrCreateGauge(formatMetricID(joinFQ("memory_sock_ratio"), labels), nil).Set(sock / currentMetrics[0].Value)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if !found {
+		return ErrFileMissing
+	}
+	return nil
+}
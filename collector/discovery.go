@@ -0,0 +1,330 @@
+package collector
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// globMeta are the characters with a special meaning in filepath.Match patterns.
+const globMeta = `*?[\`
+
+// GlobRoot returns the directory a glob pattern is anchored at, i.e. the
+// leading path elements that contain no glob metacharacters.
+func GlobRoot(pattern string) string {
+	i := strings.IndexAny(pattern, globMeta)
+	if i < 0 {
+		return filepath.Clean(pattern)
+	}
+	return filepath.Clean(pattern[:strings.LastIndex(pattern[:i], string(filepath.Separator))+1])
+}
+
+// ValidatePath resolves path through filepath.Clean and symlinks and checks
+// that the result lies within one of roots. It returns the resolved path.
+func ValidatePath(path string, roots []string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	for _, root := range roots {
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(resolvedRoot, resolved)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s resolves to %s, outside of %v", path, resolved, roots)
+}
+
+// DiscoverCgroups expands globs into the list of cgroup directories to scrape.
+// Matches escaping the root of their glob, e.g. via ".." or a symlink, are
+// rejected so that the exporter never reads files outside the cgroup hierarchy.
+func DiscoverCgroups(globs []string, logger *slog.Logger) []string {
+	roots := make([]string, 0, len(globs))
+	for _, globPattern := range globs {
+		roots = append(roots, GlobRoot(globPattern))
+	}
+
+	var cgroups []string
+	depths := make(map[string]int)
+	for _, globPattern := range globs {
+		matches, err := globDirs(globPattern)
+		if err != nil {
+			logger.Error("Failed to expand glob pattern", "pattern", globPattern, "err", err)
+			continue
+		}
+		root := GlobRoot(globPattern)
+		for _, match := range matches {
+			if match.trusted {
+				cgroups = append(cgroups, match.path)
+				recordDepth(depths, root, match.path)
+				continue
+			}
+			resolved, err := ValidatePath(match.path, roots)
+			if err != nil {
+				logger.Warn("Rejecting path outside of the glob roots", "path", match.path, "err", err)
+				continue
+			}
+			fi, err := os.Stat(resolved)
+			if err != nil {
+				logger.Error("Failed to stat path", "path", match.path, "err", err)
+				continue
+			}
+			if fi.IsDir() {
+				cgroups = append(cgroups, resolved)
+				recordDepth(depths, root, resolved)
+			}
+		}
+	}
+	if !*userSlices {
+		cgroups = slices.DeleteFunc(cgroups, inUserSlice)
+	}
+	if *sampleRate < 1 {
+		total := len(cgroups)
+		cgroups = sampleCgroups(cgroups, *sampleRate, *sampleSeed)
+		logger.Info("Sampling cgroups", "rate", *sampleRate, "seed", *sampleSeed, "sampled", len(cgroups), "discovered", total)
+	}
+	cacheCgroupLabels(cgroups)
+	// Keep only the depths of the cgroups left after filtering, replacing those
+	// of an earlier discovery.
+	discovered := make(map[string]int, len(cgroups))
+	for _, dir := range cgroups {
+		if depth, ok := depths[dir]; ok {
+			discovered[dir] = depth
+		}
+	}
+	cgroupDepths.Store(&discovered)
+	return cgroups
+}
+
+// checkSampleRate rejects a --collector.sample-rate outside of (0, 1], which
+// would sample no cgroups at all or be meaningless.
+func checkSampleRate(rate float64) error {
+	if !(rate > 0 && rate <= 1) {
+		return fmt.Errorf("--collector.sample-rate must be in (0, 1], got %v", rate)
+	}
+	return nil
+}
+
+// sampleCgroups keeps about rate of cgroups. A cgroup is kept if the hash of
+// seed and its path falls below rate, so the choice is stable across restarts
+// and independent of the other cgroups discovered.
+func sampleCgroups(cgroups []string, rate float64, seed uint64) []string {
+	return slices.DeleteFunc(cgroups, func(cgroup string) bool {
+		h := fnv.New64a()
+		binary.Write(h, binary.LittleEndian, seed)
+		h.Write([]byte(cgroup))
+		return float64(h.Sum64())/math.MaxUint64 >= rate
+	})
+}
+
+// cgroupDepths holds the depth of every discovered cgroup below the root of the
+// glob that matched it, for the cgroup.depth collector. It is replaced on
+// discovery.
+var cgroupDepths atomic.Pointer[map[string]int]
+
+// recordDepth records the number of path segments of dir below root in depths.
+// Both are resolved, as matches may be reported below the resolved root. A
+// cgroup matched by several globs gets the depth below the shallowest root.
+func recordDepth(depths map[string]int, root, dir string) {
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+	depth := 0
+	if rel != "." {
+		depth = strings.Count(rel, string(filepath.Separator)) + 1
+	}
+	if known, ok := depths[dir]; !ok || depth > known {
+		depths[dir] = depth
+	}
+}
+
+// inUserSlice reports whether dir is in the user.slice subtree, which holds
+// user sessions and user@<uid>.service managers owned by their users.
+func inUserSlice(dir string) bool {
+	return slices.Contains(strings.Split(filepath.ToSlash(dir), "/"), "user.slice")
+}
+
+// Filesystem magic numbers of the cgroup hierarchies, see statfs(2).
+const (
+	cgroup2SuperMagic = 0x63677270
+	cgroupSuperMagic  = 0x27e0eb
+)
+
+// isCgroupfs reports whether path lies on a cgroup filesystem. It is a variable
+// so tests can stub it.
+var isCgroupfs = func(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Type == cgroup2SuperMagic || st.Type == cgroupSuperMagic
+}
+
+// CgroupfsMounted reports whether a cgroup filesystem is mounted at path. In a
+// restricted container there may be none at all, leaving nothing to scrape.
+func CgroupfsMounted(path string) bool {
+	return isCgroupfs(path)
+}
+
+// CheckDiscovery guards against misconfigured globs, like /*, which would make
+// every scrape walk large parts of the filesystem. It reports the glob roots
+// that aren't on a cgroup filesystem, and more than maxCgroups discovered
+// cgroups unless maxCgroups is 0.
+func CheckDiscovery(globs, cgroups []string, maxCgroups int) error {
+	var errs []error
+	for _, globPattern := range globs {
+		if root := GlobRoot(globPattern); !isCgroupfs(root) {
+			errs = append(errs, fmt.Errorf("root %s of glob %s is not on a cgroup filesystem", root, globPattern))
+		}
+	}
+	if maxCgroups > 0 && len(cgroups) > maxCgroups {
+		errs = append(errs, fmt.Errorf("%d cgroups discovered, more than %d", len(cgroups), maxCgroups))
+	}
+	return errors.Join(errs...)
+}
+
+// globMatch is a path matched by globDirs. Trusted matches are directories
+// reached from the resolved glob root without following symlinks, so they need
+// neither validation nor a stat.
+type globMatch struct {
+	path    string
+	trusted bool
+}
+
+// globDirs expands pattern like filepath.Glob, but lists each directory level
+// with one os.ReadDir (batched getdents) and takes the entry type from the
+// directory listing, instead of stat-ing every match. Only directories and
+// symlinks, which may point to one, are returned.
+func globDirs(pattern string) ([]globMatch, error) {
+	i := strings.IndexAny(pattern, globMeta)
+	if i < 0 {
+		// Without metacharacters, only the pattern itself can match.
+		if _, err := os.Lstat(pattern); err != nil {
+			return nil, nil
+		}
+		return []globMatch{{path: pattern}}, nil
+	}
+	// Split the remainder after the root by hand, cleaning it would drop "..".
+	rest := pattern[strings.LastIndex(pattern[:i], string(filepath.Separator))+1:]
+	components := strings.Split(rest, string(filepath.Separator))
+	for _, component := range components {
+		if _, err := filepath.Match(component, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(GlobRoot(pattern))
+	if err != nil {
+		return nil, nil
+	}
+	matches := []globMatch{{path: resolvedRoot, trusted: true}}
+	for i, component := range components {
+		last := i == len(components)-1
+		var next []globMatch
+		for _, dir := range matches {
+			if !strings.ContainsAny(component, globMeta) {
+				if component == "." || component == ".." {
+					// filepath.Glob matches these against the directory
+					// listing, which never contains them.
+					continue
+				}
+				path := dir.path + string(filepath.Separator) + component
+				fi, err := os.Lstat(path)
+				if err != nil {
+					continue
+				}
+				isLink := fi.Mode()&fs.ModeSymlink != 0
+				if !fi.IsDir() && !isLink && !last {
+					continue
+				}
+				next = append(next, globMatch{path: path, trusted: dir.trusted && fi.IsDir()})
+				continue
+			}
+			entries, err := os.ReadDir(dir.path)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if matched, _ := filepath.Match(component, entry.Name()); !matched {
+					continue
+				}
+				isLink := entry.Type()&fs.ModeSymlink != 0
+				if !entry.IsDir() && !isLink {
+					continue
+				}
+				next = append(next, globMatch{
+					path:    filepath.Join(dir.path, entry.Name()),
+					trusted: dir.trusted && entry.IsDir(),
+				})
+			}
+		}
+		matches = next
+	}
+	return matches, nil
+}
+
+// CgroupOfPID returns the cgroup v2 directory of process pid. It is resolved from
+// the unified hierarchy entry ("0::/path") of <procfs>/<pid>/cgroup and must lie
+// within the cgroup mount at cgroupfs.
+func CgroupOfPID(procfs, cgroupfs string, pid int) (string, error) {
+	data, err := os.ReadFile(filepath.Join(procfs, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		path, ok := strings.CutPrefix(line, "0::")
+		if !ok {
+			continue
+		}
+		return ValidatePath(cgroupfs+"/"+path, []string{cgroupfs})
+	}
+	return "", fmt.Errorf("no cgroup v2 entry for pid %d", pid)
+}
+
+// CgroupSubtree returns those of cgroups that are dir or lie below it, at most
+// maxDepth levels deep. It fails if there are more than maxCount of them, so
+// that a request can't make the exporter scrape an arbitrarily large subtree.
+func CgroupSubtree(dir string, cgroups []string, maxDepth, maxCount int) ([]string, error) {
+	dir = filepath.Clean(dir)
+	var subtree []string
+	for _, cgroup := range cgroups {
+		cgroup = filepath.Clean(cgroup)
+		rel, err := filepath.Rel(dir, cgroup)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel != "." && strings.Count(rel, string(filepath.Separator))+1 > maxDepth {
+			continue
+		}
+		if len(subtree) == maxCount {
+			return nil, fmt.Errorf("more than %d cgroups below %s", maxCount, dir)
+		}
+		subtree = append(subtree, cgroup)
+	}
+	if len(subtree) == 0 {
+		return nil, fmt.Errorf("cgroup %q is not matched by the configured globs", dir)
+	}
+	return subtree, nil
+}
@@ -0,0 +1,335 @@
+package collector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+func TestGlobRoot(t *testing.T) {
+	tests := map[string]string{
+		"/sys/fs/cgroup/*":                      "/sys/fs/cgroup",
+		"/sys/fs/cgroup/system.slice/*.service": "/sys/fs/cgroup/system.slice",
+		"/sys/fs/cgroup/*/../../../*":           "/sys/fs/cgroup",
+		"/sys/fs/cgroup/user.slice":             "/sys/fs/cgroup/user.slice",
+		"/sys/fs/cgroup/kube[a-z]*/*":           "/sys/fs/cgroup",
+	}
+	for pattern, expected := range tests {
+		if got := GlobRoot(pattern); got != expected {
+			t.Errorf("GlobRoot(%s) = %s, expected %s", pattern, got, expected)
+		}
+	}
+}
+
+func TestCheckDiscovery(t *testing.T) {
+	tmp := t.TempDir()
+	cgroupfs := filepath.Join(tmp, "cgroup")
+	writeCgroup(t, cgroupfs, "a.service", nil)
+	writeCgroup(t, tmp, "home", nil)
+
+	defer func(orig func(string) bool) { isCgroupfs = orig }(isCgroupfs)
+	isCgroupfs = func(path string) bool { return strings.HasPrefix(path, cgroupfs) }
+
+	globs := []string{cgroupfs + "/*"}
+	cgroups := DiscoverCgroups(globs, logger)
+	if err := CheckDiscovery(globs, cgroups, 10); err != nil {
+		t.Errorf("Expected no error for a glob below the cgroup filesystem, got %v", err)
+	}
+
+	globs = []string{tmp + "/*"}
+	cgroups = DiscoverCgroups(globs, logger)
+	err := CheckDiscovery(globs, cgroups, 1)
+	if err == nil || !strings.Contains(err.Error(), "is not on a cgroup filesystem") {
+		t.Errorf("Expected an error for a glob outside of the cgroup filesystem, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "2 cgroups discovered, more than 1") {
+		t.Errorf("Expected an error for too many cgroups, got %v", err)
+	}
+	if err := CheckDiscovery(globs[:0], cgroups, 0); err != nil {
+		t.Errorf("Expected no limit with --cgroup.max=0, got %v", err)
+	}
+}
+
+func TestDiscoverCgroupsRejectsEscapes(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "cgroup")
+	writeCgroup(t, root, "a.service", nil)
+	writeCgroup(t, root, "b.service", nil)
+	outside := writeCgroup(t, tmp, "secret", map[string]string{"memory.current": "1"})
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	cgroups := DiscoverCgroups([]string{filepath.Join(root, "*")}, logger)
+	if len(cgroups) != 2 {
+		t.Fatalf("Expected 2 cgroups, got %v", cgroups)
+	}
+	for _, cgroup := range cgroups {
+		if filepath.Dir(cgroup) != root {
+			t.Errorf("Expected cgroups below %s, got %s", root, cgroup)
+		}
+	}
+
+	// ".." in the glob must not lead out of the glob root.
+	// filepath.Join would clean the pattern, so build it by hand.
+	cgroups = DiscoverCgroups([]string{root + "/*/../../*"}, logger)
+	for _, cgroup := range cgroups {
+		if cgroup == outside {
+			t.Errorf("Expected traversal to %s to be rejected", outside)
+		}
+	}
+
+	if _, err := ValidatePath(filepath.Join(root, "a.service", "..", "..", "secret"), []string{root}); err == nil {
+		t.Errorf("Expected ../ traversal to be rejected")
+	}
+	if _, err := ValidatePath(filepath.Join(root, "escape"), []string{root}); err == nil {
+		t.Errorf("Expected symlink escape to be rejected")
+	}
+	if _, err := ValidatePath(filepath.Join(root, "a.service"), []string{root}); err != nil {
+		t.Errorf("Expected cgroup within root to be accepted, got %v", err)
+	}
+}
+
+// globAndStat is the former discovery, filepath.Glob followed by validating and
+// stat-ing every match. It is the reference DiscoverCgroups must agree with.
+func globAndStat(globs []string) []string {
+	roots := make([]string, 0, len(globs))
+	for _, globPattern := range globs {
+		roots = append(roots, GlobRoot(globPattern))
+	}
+	var cgroups []string
+	for _, globPattern := range globs {
+		matches, _ := filepath.Glob(globPattern)
+		for _, match := range matches {
+			resolved, err := ValidatePath(match, roots)
+			if err != nil {
+				continue
+			}
+			if fi, err := os.Stat(resolved); err == nil && fi.IsDir() {
+				cgroups = append(cgroups, resolved)
+			}
+		}
+	}
+	return cgroups
+}
+
+func TestDiscoverCgroupsUserSlices(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "cgroup")
+	system := writeCgroup(t, root, "system.slice/a.service", nil)
+	writeCgroup(t, root, "user.slice/user-1000.slice/user@1000.service", nil)
+	pattern := root + "/*/*"
+
+	if got := DiscoverCgroups([]string{pattern}, logger); len(got) != 2 {
+		t.Errorf("Expected user slices to be included by default, got %v", got)
+	}
+
+	defer func() { *userSlices = true }()
+	*userSlices = false
+	if got := DiscoverCgroups([]string{pattern}, logger); !slices.Equal(got, []string{system}) {
+		t.Errorf("Expected only %s without user slices, got %v", system, got)
+	}
+}
+
+func TestSampleCgroups(t *testing.T) {
+	cgroups := make([]string, 1000)
+	for i := range cgroups {
+		cgroups[i] = fmt.Sprintf("/sys/fs/cgroup/kubepods.slice/pod%d.slice", i)
+	}
+
+	sampled := sampleCgroups(slices.Clone(cgroups), 0.1, 42)
+	if len(sampled) < 70 || len(sampled) > 130 {
+		t.Errorf("Expected about 100 of 1000 cgroups sampled, got %d", len(sampled))
+	}
+	if again := sampleCgroups(slices.Clone(cgroups), 0.1, 42); !slices.Equal(again, sampled) {
+		t.Errorf("Expected the same sample for the same seed")
+	}
+	if other := sampleCgroups(slices.Clone(cgroups), 0.1, 43); slices.Equal(other, sampled) {
+		t.Errorf("Expected another seed to sample other cgroups")
+	}
+	if all := sampleCgroups(slices.Clone(cgroups), 1, 42); len(all) != len(cgroups) {
+		t.Errorf("Expected all cgroups at rate 1, got %d", len(all))
+	}
+
+	defer func(rate float64) { *sampleRate = rate }(*sampleRate)
+	for rate, valid := range map[string]bool{"0.5": true, "1": true, "0": false, "-0.1": false, "1.5": false, "NaN": false} {
+		app := kingpin.New("test", "")
+		RegisterFlags(app)
+		if _, err := app.Parse([]string{"--collector.sample-rate=" + rate}); (err == nil) != valid {
+			t.Errorf("Expected --collector.sample-rate=%s valid %t, got error %v", rate, valid, err)
+		}
+	}
+}
+
+func TestCgroupDepth(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "cgroup")
+	writeCgroup(t, root, "kubepods.slice/burstable.slice/pod1.slice/ctr.scope", nil)
+	writeCgroup(t, root, "system.slice/a.service", nil)
+
+	cgroups := DiscoverCgroups([]string{root, root + "/*", root + "/*/*", root + "/*/*/*/*"}, logger)
+	c, err := NewCgroupDepthCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_cgroup_depth{cgroup="cgroup"} 0`,
+		`cgroupv2_cgroup_depth{cgroup="kubepods_slice"} 1`,
+		`cgroupv2_cgroup_depth{cgroup="system_slice"} 1`,
+		`cgroupv2_cgroup_depth{cgroup="burstable_slice"} 2`,
+		`cgroupv2_cgroup_depth{cgroup="a_service"} 2`,
+		`cgroupv2_cgroup_depth{cgroup="ctr_scope"} 4`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	// Depths are relative to the glob root.
+	cgroups = DiscoverCgroups([]string{root + "/kubepods.slice/*/*"}, logger)
+	c, _ = NewCgroupDepthCollector(logger, cgroups)
+	if out, _ := scrape(c); !strings.Contains(out, `cgroupv2_cgroup_depth{cgroup="pod1_slice"} 2`) {
+		t.Errorf("Expected pod1.slice at depth 2 below kubepods.slice, got:\n%s", out)
+	}
+	// Cgroups of an earlier discovery are dropped.
+	if _, ok := (*cgroupDepths.Load())[filepath.Join(root, "system.slice")]; ok {
+		t.Errorf("Expected no depth for a cgroup no longer discovered")
+	}
+
+	// A cgroup matched by several globs is at its depth below the shallowest root,
+	// whichever glob comes last.
+	for _, globs := range [][]string{
+		{root + "/*/*", root + "/kubepods.slice/*"},
+		{root + "/kubepods.slice/*", root + "/*/*"},
+	} {
+		cgroups = DiscoverCgroups(globs, logger)
+		c, _ = NewCgroupDepthCollector(logger, cgroups)
+		if out, _ := scrape(c); !strings.Contains(out, `cgroupv2_cgroup_depth{cgroup="burstable_slice"} 2`) {
+			t.Errorf("Expected burstable.slice at depth 2 for globs %v, got:\n%s", globs, out)
+		}
+	}
+}
+
+func TestDiscoverCgroupsMatchesGlob(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "cgroup")
+	writeCgroup(t, root, "a.service", map[string]string{"memory.current": "1"})
+	writeCgroup(t, root, "x.slice/y.service", nil)
+	writeCgroup(t, root, "x.slice/z.scope", nil)
+	writeCgroup(t, root, ".hidden", nil)
+	writeCgroup(t, tmp, "secret", nil)
+	if err := os.WriteFile(filepath.Join(root, "cgroup.procs"), nil, 0o644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "x.slice"), filepath.Join(root, "link.slice")); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "secret"), filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	for _, pattern := range []string{
+		root + "/*",
+		root + "/*.service",
+		root + "/*/*",
+		root + "/x.slice/*",
+		root + "/*/y.service",
+		root + "/x.slice",
+		root + "/*/../*",
+		root + "/[a-x]*",
+		root + "/nope/*",
+	} {
+		expected := globAndStat([]string{pattern})
+		got := DiscoverCgroups([]string{pattern}, logger)
+		if !slices.Equal(got, expected) {
+			t.Errorf("DiscoverCgroups(%s) = %v, expected %v", pattern, got, expected)
+		}
+	}
+
+	if got := DiscoverCgroups([]string{root + "/[a-"}, logger); len(got) != 0 {
+		t.Errorf("Expected no cgroups for a malformed pattern, got %v", got)
+	}
+}
+
+func BenchmarkDiscoverCgroups(b *testing.B) {
+	root := b.TempDir()
+	for i := range 5000 {
+		if err := os.Mkdir(filepath.Join(root, fmt.Sprintf("app-%d.scope", i)), 0o755); err != nil {
+			b.Fatalf("Error creating cgroup dir: %v", err)
+		}
+	}
+	globs := []string{root + "/*.scope"}
+
+	b.Run("readdir", func(b *testing.B) {
+		for b.Loop() {
+			DiscoverCgroups(globs, logger)
+		}
+	})
+	b.Run("glob+stat", func(b *testing.B) {
+		for b.Loop() {
+			globAndStat(globs)
+		}
+	})
+}
+
+func TestUpdateRefusesSymlinkedFile(t *testing.T) {
+	tmp := t.TempDir()
+	cgroup := writeCgroup(t, tmp, "app", nil)
+	secret := filepath.Join(tmp, "secret")
+	if err := os.WriteFile(secret, []byte("42"), 0o644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.Symlink(secret, filepath.Join(cgroup, "memory.current")); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	c, err := NewMemoryCurrentCollector(logger, []string{cgroup})
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, _ := scrape(c)
+	if out != "" {
+		t.Errorf("Expected symlinked file not to be read, got:\n%s", out)
+	}
+}
+
+func TestCgroupSubtree(t *testing.T) {
+	cgroups := []string{
+		"/sys/fs/cgroup/app.slice",
+		"/sys/fs/cgroup/app.slice/a.service",
+		"/sys/fs/cgroup/app.slice/a.service/worker",
+		"/sys/fs/cgroup/app.slice/b.service",
+		"/sys/fs/cgroup/app.slicer",
+		"/sys/fs/cgroup/other.slice",
+	}
+
+	subtree, err := CgroupSubtree("/sys/fs/cgroup/app.slice/", cgroups, 8, 10)
+	if err != nil {
+		t.Fatalf("Error calling CgroupSubtree: %v", err)
+	}
+	if expected := cgroups[:4]; !slices.Equal(subtree, expected) {
+		t.Errorf("Expected %v, got %v", expected, subtree)
+	}
+
+	subtree, err = CgroupSubtree("/sys/fs/cgroup/app.slice", cgroups, 1, 10)
+	if err != nil {
+		t.Fatalf("Error calling CgroupSubtree: %v", err)
+	}
+	if expected := []string{cgroups[0], cgroups[1], cgroups[3]}; !slices.Equal(subtree, expected) {
+		t.Errorf("Expected %v with depth 1, got %v", expected, subtree)
+	}
+
+	if _, err := CgroupSubtree("/sys/fs/cgroup/app.slice", cgroups, 8, 3); err == nil {
+		t.Errorf("Expected an error for more than 3 cgroups")
+	}
+	if _, err := CgroupSubtree("/sys/fs/cgroup/user.slice", cgroups, 8, 10); err == nil {
+		t.Errorf("Expected an error for a cgroup outside of the discovered ones")
+	}
+}
@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/asama-ai/cgroupv2_exporter/parsers"
+)
+
+// fileIncludes are the globs of --collector.file-include.
+var fileIncludes = new([]string)
+
+// RegisterFileIncludes registers a collector for every file of the first cgroup
+// matching a --collector.file-include glob that no collector covers yet and
+// whose format the AutoParser knows. It returns the names of the new
+// collectors, which are enabled.
+func RegisterFileIncludes(cgroups []string, logger *slog.Logger) []string {
+	if len(*fileIncludes) == 0 || len(cgroups) == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(cgroups[0])
+	if err != nil {
+		logger.Error("couldn't list files to include", "dir", cgroups[0], "err", err)
+		return nil
+	}
+
+	var registered []string
+	for _, entry := range entries {
+		file := entry.Name()
+		if entry.IsDir() || factories[file] != nil || !matchesAny(*fileIncludes, file) {
+			continue
+		}
+		if detectFormat(filepath.Join(cgroups[0], file)) == parsers.FormatUnknown {
+			logger.Debug("unknown format, not including file", "file", file)
+			continue
+		}
+		registerCollector(file, defaultEnabled, func(logger *slog.Logger, cgroups []string) (Collector, error) {
+			fileLogger := logger.With("file", file)
+			return &Cgroupv2FileCollector{
+				parser: &parsers.AutoParser{
+					MetricPrefix: sanitizeP8sName(file),
+					Logger:       fileLogger,
+				},
+				dirNames:  cgroups,
+				fileName:  file,
+				logger:    fileLogger,
+				isCounter: func(metricName string, labels map[string]string) bool { return false },
+			}, nil
+		})
+		registered = append(registered, file)
+	}
+	return registered
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFormat returns the format of the first non-empty line of filePath, or
+// parsers.FormatUnknown for unreadable files.
+func detectFormat(filePath string) parsers.Format {
+	file, err := openFile(filePath)
+	if err != nil {
+		return parsers.FormatUnknown
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return parsers.DetectFormat(line)
+		}
+	}
+	return parsers.FormatUnknown
+}
@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRegisterFileIncludes(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{writeCgroup(t, root, "app", map[string]string{
+		"memory.current":    "100\n",
+		"memory.min":        "0\n",
+		"memory.low":        "max\n",
+		"memory.events":     "low 0\nhigh 3\nmax 1\noom 0\noom_kill 0\n",
+		"memory.numa_stat":  "anon N0=4096 N1=0\nfile N0=8192 N1=1024\n",
+		"memory.oom.group":  "0\n",
+		"memory.reclaim":    "",
+		"memory.zswap.mode": "lz4 zstd\n",
+		"cpu.weight":        "100\n",
+	})}
+
+	*fileIncludes = []string{"memory.*"}
+	defer func() { *fileIncludes = nil }()
+	registered := RegisterFileIncludes(cgroups, logger)
+	defer func() {
+		for _, name := range registered {
+			delete(factories, name)
+			delete(collectorState, name)
+			delete(defaultState, name)
+		}
+	}()
+
+	slices.Sort(registered)
+	expected := []string{"memory.events", "memory.low", "memory.min", "memory.numa_stat", "memory.oom.group"}
+	if !slices.Equal(registered, expected) {
+		t.Fatalf("Expected collectors %v, got %v", expected, registered)
+	}
+
+	cgc, err := NewCgroupv2SubsetCollector(cgroups, logger, registered...)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	var out strings.Builder
+	for _, name := range registered {
+		o, err := scrape(cgc.Collectors[name])
+		if err != nil {
+			t.Fatalf("Error updating %s: %v", name, err)
+		}
+		out.WriteString(o)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_min{cgroup="app"} 0`,
+		`cgroupv2_memory_low{cgroup="app"} +Inf`,
+		`cgroupv2_memory_events{cgroup="app",stat="high"} 3`,
+		`cgroupv2_memory_numa_stat_N1{cgroup="app",device="file"} 1024`,
+		`cgroupv2_memory_oom_group{cgroup="app"} 0`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out.String())
+		}
+	}
+}
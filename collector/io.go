@@ -8,23 +8,26 @@ import (
 
 func NewIoPressureCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "io.pressure"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.NestedKeyValueParser{
 			MetricPrefix: sanitizeP8sName(file),
 			Logger:       fileLogger,
+			PrefixInName: *psiLayout == layoutName,
 		},
-		dirNames:  cgroups,
-		fileName:  file,
-		logger:    fileLogger,
-		isCounter: func(metricName string, _ map[string]string) bool { return isPressureTotalField(metricName) },
+		dirNames:        cgroups,
+		fileName:        file,
+		logger:          fileLogger,
+		isCounter:       isPressureTotalField,
+		stallHistogram:  true,
+		pressureEnabled: pressureEnabledReader(logger),
 	}, nil
 }
 
 func NewIoStatCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "io.stat"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.NestedKeyValueParser{
@@ -34,7 +37,121 @@ func NewIoStatCollector(logger *slog.Logger, cgroups []string) (Collector, error
 		dirNames: cgroups,
 		fileName: file,
 		logger:   fileLogger,
-		// Per-device rbytes, wbytes, rios, wios, etc. are cumulative.
-		isCounter: func(metricName string, labels map[string]string) bool { return true },
+		isCounter: func(metricName string, labels map[string]string) bool {
+			counter, known := ioStatFields[metricName]
+			if !known && metricName != ioStatDevices {
+				fileLogger.Debug("unknown io.stat field, exposing it as gauge", "name", metricName)
+			}
+			return counter
+		},
+		extraMetrics: func(metricsFromFile []parsers.Metric) []parsers.Metric {
+			return append(countIoStatDevices(metricsFromFile), ioStatAverages(metricsFromFile)...)
+		},
+	}, nil
+}
+
+// ioStatFields tells for the known io.stat fields whether they are counters.
+// Besides the per-device byte and operation counts, io.cost adds its cost.*
+// fields and io.latency its depth, avg_lat and win.
+var ioStatFields = map[string]bool{
+	"io_stat_rbytes":       true,
+	"io_stat_wbytes":       true,
+	"io_stat_rios":         true,
+	"io_stat_wios":         true,
+	"io_stat_dbytes":       true,
+	"io_stat_dios":         true,
+	"io_stat_cost_usage":   true,
+	"io_stat_cost_wait":    true,
+	"io_stat_cost_indebt":  true,
+	"io_stat_cost_indelay": true,
+	"io_stat_cost_vrate":   false,
+	"io_stat_depth":        false,
+	"io_stat_avg_lat":      false,
+	"io_stat_win":          false,
+	ioStatAvgReadBytes:     false,
+	ioStatAvgWriteBytes:    false,
+}
+
+const ioStatDevices = "io_stat_devices"
+
+// countIoStatDevices reports the number of devices a cgroup has done IO on.
+func countIoStatDevices(metricsFromFile []parsers.Metric) []parsers.Metric {
+	devices := make(map[string]bool)
+	for _, m := range metricsFromFile {
+		devices[m.Labels["device"]] = true
+	}
+	return []parsers.Metric{{Name: ioStatDevices, Value: float64(len(devices)), Labels: map[string]string{}}}
+}
+
+const (
+	ioStatAvgReadBytes  = "io_stat_avg_read_bytes"
+	ioStatAvgWriteBytes = "io_stat_avg_write_bytes"
+)
+
+// ioStatAverages derives the average read and write request size of every
+// device, rbytes/rios and wbytes/wios, since the cgroup was created. Devices
+// without any request of a kind get no average.
+func ioStatAverages(metricsFromFile []parsers.Metric) []parsers.Metric {
+	values := make(map[string]map[string]float64)
+	for _, m := range metricsFromFile {
+		device := m.Labels["device"]
+		if values[device] == nil {
+			values[device] = make(map[string]float64)
+		}
+		values[device][m.Name] = m.Value
+	}
+
+	var averages []parsers.Metric
+	for device, v := range values {
+		if ios := v["io_stat_rios"]; ios > 0 {
+			averages = append(averages, parsers.Metric{Name: ioStatAvgReadBytes, Value: v["io_stat_rbytes"] / ios, Labels: map[string]string{"device": device}})
+		}
+		if ios := v["io_stat_wios"]; ios > 0 {
+			averages = append(averages, parsers.Metric{Name: ioStatAvgWriteBytes, Value: v["io_stat_wbytes"] / ios, Labels: map[string]string{"device": device}})
+		}
+	}
+	return averages
+}
+
+// NewIoCostQosCollector reports the per-device io.cost QoS parameters. The file
+// only exists in the root cgroup, which unfiltered scrapes add as cgroup="root".
+func NewIoCostQosCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "io.cost.qos"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.NestedKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			SkipKeys:     []string{"ctrl"},
+		},
+		dirNames:     cgroups,
+		fileName:     file,
+		logger:       fileLogger,
+		isCounter:    func(metricName string, labels map[string]string) bool { return false },
+		rootDir:      rootCgroup,
+		cgroupFilter: isRootCgroup,
+	}, nil
+}
+
+// NewIoCostModelCollector reports the per-device io.cost cost model parameters.
+// The file only exists in the root cgroup, which unfiltered scrapes add as
+// cgroup="root".
+func NewIoCostModelCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "io.cost.model"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.NestedKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			SkipKeys:     []string{"ctrl", "model"},
+		},
+		dirNames:     cgroups,
+		fileName:     file,
+		logger:       fileLogger,
+		isCounter:    func(metricName string, labels map[string]string) bool { return false },
+		rootDir:      rootCgroup,
+		cgroupFilter: isRootCgroup,
 	}, nil
 }
@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
+)
+
+// cgroupLabelData is the data --collector.cgroup-label-template is executed with.
+type cgroupLabelData struct {
+	Name     string // sanitized basename, the default label value
+	Basename string
+	Path     string
+	Parent   string // basename of the parent directory
+	Depth    int    // number of path elements below --path.cgroupfs, or of the whole path outside of it
+}
+
+func newCgroupLabelData(dirName string) cgroupLabelData {
+	path := filepath.Clean(dirName)
+	rel, err := filepath.Rel(rootCgroup, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(path, string(filepath.Separator))
+	}
+	depth := 0
+	if rel != "." && rel != "" {
+		depth = strings.Count(rel, string(filepath.Separator)) + 1
+	}
+	return cgroupLabelData{
+		Name:     sanitizeP8sName(filepath.Base(path)),
+		Basename: filepath.Base(path),
+		Path:     path,
+		Parent:   filepath.Base(filepath.Dir(path)),
+		Depth:    depth,
+	}
+}
+
+// containerIDPattern matches the cgroups of Docker and containerd containers:
+// docker-<id>.scope and cri-containerd-<id>.scope with the systemd cgroup
+// driver, or just <id> with the cgroupfs driver.
+var containerIDPattern = regexp.MustCompile(`^(?:(?:docker|cri-containerd)-([0-9a-f]{64})\.scope|([0-9a-f]{64}))$`)
+
+// shortContainerIDLength is the length of the container IDs shown by docker ps.
+const shortContainerIDLength = 12
+
+// cgroupBaseLabels returns the labels identifying the cgroup dirName on each of
+// its metrics: cgroup and, with --collector.docker-labels, container_id. All
+// collectors build on them, so that their metrics of a cgroup can be joined.
+func cgroupBaseLabels(dirName string) map[string]string {
+	labels := map[string]string{"cgroup": cgroupLabel(dirName)}
+	if id := containerID(dirName); *dockerLabels && id != "" {
+		labels["container_id"] = id
+	}
+	return labels
+}
+
+// containerID returns the short ID of the container whose cgroup is dirName,
+// or "" if dirName isn't the cgroup of a container.
+func containerID(dirName string) string {
+	match := containerIDPattern.FindStringSubmatch(filepath.Base(dirName))
+	if match == nil {
+		return ""
+	}
+	return (match[1] + match[2])[:shortContainerIDLength]
+}
+
+var (
+	cgroupLabelTemplateText = new(string)
+	cgroupLabelTemplate     atomic.Pointer[template.Template]
+	// cgroupLabels holds the label of every discovered cgroup by directory. It
+	// is replaced on discovery, dropping the cgroups no longer discovered.
+	cgroupLabels atomic.Pointer[map[string]string]
+)
+
+// setCgroupLabelTemplate parses the template computing the cgroup label, and
+// executes it once so that e.g. unknown fields are reported at startup rather
+// than on every scrape. An empty text restores the sanitized basename.
+func setCgroupLabelTemplate(text string) error {
+	var tmpl *template.Template
+	if text != "" {
+		var err error
+		tmpl, err = template.New("cgroup-label").Funcs(template.FuncMap{"sanitize": sanitizeP8sName}).Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid cgroup label template: %w", err)
+		}
+		if err := tmpl.Execute(io.Discard, newCgroupLabelData(filepath.Join(rootCgroup, "system.slice/example.service"))); err != nil {
+			return fmt.Errorf("invalid cgroup label template: %w", err)
+		}
+	}
+
+	cgroupLabelTemplate.Store(tmpl)
+	cgroupLabels.Store(nil)
+	return nil
+}
+
+// cacheCgroupLabels computes the labels of the discovered cgroups once, so that
+// scrapes don't execute the template for every metric.
+func cacheCgroupLabels(cgroups []string) {
+	tmpl := cgroupLabelTemplate.Load()
+	if tmpl == nil {
+		cgroupLabels.Store(nil)
+		return
+	}
+	labels := make(map[string]string, len(cgroups))
+	for _, dirName := range cgroups {
+		labels[dirName] = executeCgroupLabel(tmpl, dirName)
+	}
+	cgroupLabels.Store(&labels)
+}
+
+// cgroupLabel returns the value of the cgroup label for the cgroup directory dirName.
+func cgroupLabel(dirName string) string {
+	tmpl := cgroupLabelTemplate.Load()
+	if tmpl == nil {
+		return sanitizeP8sName(filepath.Base(dirName))
+	}
+	if labels := cgroupLabels.Load(); labels != nil {
+		if label, ok := (*labels)[dirName]; ok {
+			return label
+		}
+	}
+	return executeCgroupLabel(tmpl, dirName)
+}
+
+func executeCgroupLabel(tmpl *template.Template, dirName string) string {
+	data := newCgroupLabelData(dirName)
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return data.Name
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package collector
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCgroupLabelTemplate(t *testing.T) {
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "system.slice/foo.service", map[string]string{"memory.current": "1\n"}),
+		writeCgroup(t, root, "user.slice/foo.service", map[string]string{"memory.current": "2\n"}),
+	}
+
+	if err := setCgroupLabelTemplate("{{.Parent | sanitize}}_{{.Name}}"); err != nil {
+		t.Fatalf("Error setting template: %v", err)
+	}
+	defer setCgroupLabelTemplate("")
+
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	// With the default label, both cgroups would collide on foo_service.
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="system_slice_foo_service"} 1`,
+		`cgroupv2_memory_current{cgroup="user_slice_foo_service"} 2`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	// Discovery caches the labels of the discovered cgroups only.
+	DiscoverCgroups([]string{filepath.Join(root, "system.slice/*")}, logger)
+	if labels := cgroupLabels.Load(); labels == nil || len(*labels) != 1 || (*labels)[cgroups[0]] != "system_slice_foo_service" {
+		t.Errorf("Expected the label of %s cached, got %v", cgroups[0], labels)
+	}
+	DiscoverCgroups([]string{filepath.Join(root, "user.slice/*")}, logger)
+	if labels := cgroupLabels.Load(); labels == nil || len(*labels) != 1 || (*labels)[cgroups[1]] != "user_slice_foo_service" {
+		t.Errorf("Expected the label of %s cached, got %v", cgroups[1], labels)
+	}
+
+	for _, text := range []string{"{{.Parent", "{{.Nope}}", "{{nope .Name}}"} {
+		if err := setCgroupLabelTemplate(text); err == nil {
+			t.Errorf("Expected template %q to be rejected", text)
+		}
+	}
+}
+
+func TestCgroupLabelData(t *testing.T) {
+	tests := []struct {
+		dir      string
+		expected cgroupLabelData
+	}{
+		{"/sys/fs/cgroup/system.slice/foo.service", cgroupLabelData{Name: "foo_service", Basename: "foo.service", Path: "/sys/fs/cgroup/system.slice/foo.service", Parent: "system.slice", Depth: 2}},
+		{"/sys/fs/cgroup", cgroupLabelData{Name: "cgroup", Basename: "cgroup", Path: "/sys/fs/cgroup", Parent: "fs", Depth: 0}},
+		{"/tmp/cgroup/app", cgroupLabelData{Name: "app", Basename: "app", Path: "/tmp/cgroup/app", Parent: "cgroup", Depth: 3}},
+	}
+	for _, tt := range tests {
+		if got := newCgroupLabelData(tt.dir); got != tt.expected {
+			t.Errorf("newCgroupLabelData(%s) = %+v, expected %+v", tt.dir, got, tt.expected)
+		}
+	}
+
+	// The depth is relative to --path.cgroupfs.
+	defer func(orig string) { rootCgroup = orig }(rootCgroup)
+	SetRootCgroup("/host/sys/fs/cgroup/")
+	if got := newCgroupLabelData("/host/sys/fs/cgroup/system.slice/foo.service").Depth; got != 2 {
+		t.Errorf("Expected depth 2 below the configured root, got %d", got)
+	}
+}
+
+func TestDockerLabels(t *testing.T) {
+	const id = "3f4e8a5b9c1d2e7f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7"
+	root := t.TempDir()
+	cgroups := []string{
+		writeCgroup(t, root, "system.slice/docker-"+id+".scope", map[string]string{"memory.current": "1\n"}),
+		writeCgroup(t, root, "docker/"+id, map[string]string{"memory.current": "2\n"}),
+		writeCgroup(t, root, "system.slice/docker.service", map[string]string{"memory.current": "3\n"}),
+	}
+
+	*dockerLabels = true
+	defer func() { *dockerLabels = false }()
+
+	c, err := NewMemoryCurrentCollector(logger, cgroups)
+	if err != nil {
+		t.Fatalf("Error creating collector: %v", err)
+	}
+	out, err := scrape(c)
+	if err != nil {
+		t.Fatalf("Error calling Update: %v", err)
+	}
+	for _, expected := range []string{
+		`cgroupv2_memory_current{cgroup="docker_` + id + `_scope",container_id="3f4e8a5b9c1d"} 1`,
+		`cgroupv2_memory_current{cgroup="` + id + `",container_id="3f4e8a5b9c1d"} 2`,
+		`cgroupv2_memory_current{cgroup="docker_service"} 3`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	// Derived metrics carry container_id too, to be joined with the file metrics.
+	container := writeCgroup(t, root, "system.slice/docker-"+id+".scope", map[string]string{"memory.max": "4\n"})
+	for _, tc := range []struct {
+		factory  func(*slog.Logger, []string) (Collector, error)
+		expected string
+	}{
+		{NewMemoryUtilizationCollector, `cgroupv2_memory_utilization_ratio{cgroup="docker_` + id + `_scope",container_id="3f4e8a5b9c1d"} 0.25`},
+		{NewCgroupIsLeafCollector, `cgroupv2_cgroup_is_leaf{cgroup="docker_` + id + `_scope",container_id="3f4e8a5b9c1d"} 1`},
+	} {
+		c, err := tc.factory(logger, []string{container})
+		if err != nil {
+			t.Fatalf("Error creating collector: %v", err)
+		}
+		if out, _ := scrape(c); !strings.Contains(out, tc.expected) {
+			t.Errorf("Expected %s, got:\n%s", tc.expected, out)
+		}
+	}
+
+	for _, dirName := range []string{
+		"/sys/fs/cgroup/system.slice/docker-3f4e8a5b9c1d.scope",
+		"/sys/fs/cgroup/system.slice/docker-" + id + ".service",
+		"/sys/fs/cgroup/docker/" + strings.ToUpper(id),
+	} {
+		if got := containerID(dirName); got != "" {
+			t.Errorf("Expected no container ID for %s, got %q", dirName, got)
+		}
+	}
+	if got := containerID("/sys/fs/cgroup/kubepods.slice/cri-containerd-" + id + ".scope"); got != "3f4e8a5b9c1d" {
+		t.Errorf("Expected 3f4e8a5b9c1d for a containerd scope, got %q", got)
+	}
+}
@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"io"
 	"log/slog"
 	"strings"
 
@@ -17,13 +18,14 @@ func memoryStatIsCounter(stat string) bool {
 		return true
 	}
 	if strings.HasPrefix(stat, "workingset_") {
-		return true
+		// workingset_nodes counts shadow nodes currently in use.
+		return stat != "workingset_nodes"
 	}
 	if strings.HasPrefix(stat, "thp_") {
 		return true
 	}
 	switch stat {
-	case "pgfault", "pgmajfault", "pgrefill", "pgactivate", "pgdeactivate",
+	case "pgfault", "pgmajfault", "pgrefill", "pgscan", "pgsteal", "pgactivate", "pgdeactivate",
 		"oom_kill", "pglazyfree", "pglazyfreed":
 		return true
 	default:
@@ -33,39 +35,119 @@ func memoryStatIsCounter(stat string) bool {
 
 func NewMemoryPressureCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "memory.pressure"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.NestedKeyValueParser{
 			MetricPrefix: sanitizeP8sName(file),
 			Logger:       fileLogger,
+			PrefixInName: *psiLayout == layoutName,
 		},
-		dirNames:  cgroups,
-		fileName:  file,
-		logger:    fileLogger,
-		isCounter: func(metricName string, _ map[string]string) bool { return isPressureTotalField(metricName) },
+		dirNames:        cgroups,
+		fileName:        file,
+		logger:          fileLogger,
+		isCounter:       isPressureTotalField,
+		stallHistogram:  true,
+		pressureEnabled: pressureEnabledReader(logger),
 	}, nil
 }
 
 func NewMemoryCurrentCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "memory.current"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.SingleValueParser{
 			MetricPrefix: sanitizeP8sName(file),
 			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
 		},
 		dirNames:  cgroups,
 		fileName:  file,
 		logger:    fileLogger,
 		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		zeroFill:  true,
 	}, nil
 }
 
 func NewMemorySwapCurrentCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "memory.swap.current"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		zeroFill:  true,
+	}, nil
+}
+
+func NewMemorySwapPeakCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "memory.swap.peak"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		zeroFill:  true,
+	}, nil
+}
+
+// NewMemoryZswapCurrentCollector reports the size of the cgroup's compressed
+// swap pool in zswap, on kernels with zswap.
+func NewMemoryZswapCurrentCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "memory.zswap.current"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
+// NewMemoryZswapMaxCollector reports the zswap usage limit, +Inf when unlimited ("max").
+func NewMemoryZswapMaxCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "memory.zswap.max"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.SingleValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+	}, nil
+}
+
+// NewMemoryZswapWritebackCollector reports whether pages in zswap may be written
+// back to the swap device (1) or not (0).
+func NewMemoryZswapWritebackCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "memory.zswap.writeback"
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.SingleValueParser{
@@ -81,12 +163,13 @@ func NewMemorySwapCurrentCollector(logger *slog.Logger, cgroups []string) (Colle
 
 func NewMemoryHighCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "memory.high"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.SingleValueParser{
 			MetricPrefix: sanitizeP8sName(file),
 			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
 		},
 		dirNames:  cgroups,
 		fileName:  file,
@@ -95,15 +178,100 @@ func NewMemoryHighCollector(logger *slog.Logger, cgroups []string) (Collector, e
 	}, nil
 }
 
-func NewMemoryStatCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
-	file := "memory.stat"
-	fileLogger := slog.With(logger, "file", file)
+func NewMemoryPeakCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "memory.peak"
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
-		parser: &parsers.FlatKeyValueParser{
+		parser: &parsers.SingleValueParser{
 			MetricPrefix: sanitizeP8sName(file),
 			Logger:       fileLogger,
+			ParseUnits:   *parseUnits,
 		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		zeroFill:  true,
+	}, nil
+}
+
+// memoryStatParser parses memory.stat and appends _total to the names of
+// counters. In the label layout, gauges become memory_stat{stat=...} and, since
+// a metric family has a single type, counters memory_stat_total{stat=...}. In
+// the name layout, e.g. memory_stat_anon and memory_stat_pgfault_total.
+type memoryStatParser struct {
+	parsers.FlatKeyValueParser
+	// ReclaimKind moves the reclaimer of the pgscan_* and pgsteal_* keys,
+	// e.g. kswapd or direct, into a reclaim_kind label. The pgscan and pgsteal
+	// totals are dropped, as summing over reclaim_kind would count them twice.
+	ReclaimKind bool
+}
+
+func (p *memoryStatParser) Parse(file io.Reader) ([]parsers.Metric, error) {
+	metrics, err := p.FlatKeyValueParser.Parse(file)
+	kept := metrics[:0]
+	for _, metric := range metrics {
+		stat := metric.Labels["stat"]
+		if p.KeyInName {
+			stat = strings.TrimPrefix(metric.Name, p.MetricPrefix+"_")
+		}
+		if p.ReclaimKind {
+			if stat == "pgscan" || stat == "pgsteal" {
+				continue
+			}
+			stat = p.splitReclaimKind(&metric, stat)
+		}
+		if memoryStatIsCounter(stat) {
+			metric.Name += "_total"
+		}
+		kept = append(kept, metric)
+	}
+	return kept, err
+}
+
+// splitReclaimKind turns a pgscan_<kind> or pgsteal_<kind> metric into pgscan
+// or pgsteal with a reclaim_kind="<kind>" label and returns the new stat.
+func (p *memoryStatParser) splitReclaimKind(metric *parsers.Metric, stat string) string {
+	base, kind, ok := strings.Cut(stat, "_")
+	if !ok || base != "pgscan" && base != "pgsteal" {
+		return stat
+	}
+	if p.KeyInName {
+		metric.Name = p.MetricPrefix + "_" + base
+	} else {
+		metric.Labels["stat"] = base
+	}
+	metric.Labels["reclaim_kind"] = kind
+	return base
+}
+
+func NewMemoryStatCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "memory.stat"
+	fileLogger := logger.With("file", file)
+	prefix := sanitizeP8sName(file)
+
+	if *memoryStatLayout == layoutName {
+		return &Cgroupv2FileCollector{
+			parser: &memoryStatParser{parsers.FlatKeyValueParser{
+				MetricPrefix: prefix,
+				Logger:       fileLogger,
+				KeyInName:    true,
+			}, *memoryStatReclaimKind},
+			dirNames: cgroups,
+			fileName: file,
+			logger:   fileLogger,
+			isCounter: func(metricName string, _ map[string]string) bool {
+				return memoryStatIsCounter(strings.TrimPrefix(metricName, prefix+"_"))
+			},
+		}, nil
+	}
+
+	return &Cgroupv2FileCollector{
+		parser: &memoryStatParser{parsers.FlatKeyValueParser{
+			MetricPrefix: prefix,
+			Logger:       fileLogger,
+		}, *memoryStatReclaimKind},
 		dirNames: cgroups,
 		fileName: file,
 		logger:   fileLogger,
@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path/filepath"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/asama-ai/cgroupv2_exporter/parsers"
+)
+
+// procfs is the mount point of the proc filesystem.
+var procfs = "/proc"
+
+// SetProcfs sets the mount point of the proc filesystem, which the
+// node.pressure collector reads system-wide PSI from.
+func SetProcfs(dir string) {
+	procfs = filepath.Clean(dir)
+}
+
+// nodePressureResources are the files of /proc/pressure, by the resource label.
+var nodePressureResources = []string{"cpu", "memory", "io", "irq"}
+
+type nodePressureCollector struct {
+	parser *parsers.NestedKeyValueParser
+	logger *slog.Logger
+}
+
+// NewNodePressureCollector reports the system-wide PSI of /proc/pressure, e.g.
+// cgroupv2_node_pressure_avg10{resource="cpu",type="some"}. It doesn't depend
+// on the cgroups, so node-level pressure is available even where cgroups lack
+// PSI.
+func NewNodePressureCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	nodeLogger := logger.With("file", "/proc/pressure")
+	return &nodePressureCollector{
+		parser: &parsers.NestedKeyValueParser{MetricPrefix: "node_pressure", Logger: nodeLogger},
+		logger: nodeLogger,
+	}, nil
+}
+
+func (nc *nodePressureCollector) checkAvailable(string) error {
+	// The kernel always provides cpu with PSI enabled.
+	return readAll(filepath.Join(procfs, "pressure", "cpu"))
+}
+
+func (nc *nodePressureCollector) Update(metricSet *metrics.Set) error {
+	found := false
+	var errs []error
+	for _, resource := range nodePressureResources {
+		file, err := openFile(filepath.Join(procfs, "pressure", resource))
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			nc.logger.Debug("failed to open file", "resource", resource, "err", err)
+			continue
+		}
+		metricsFromFile, err := nc.parser.Parse(file)
+		file.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		found = true
+		for _, m := range metricsFromFile {
+			labels := maps.Clone(m.Labels)
+			labels["resource"] = resource
+			id := formatMetricID(joinFQ(m.Name), labels)
+			if isPressureTotalField(m.Name, m.Labels) {
+				metricSet.GetOrCreateFloatCounter(id).Set(m.Value)
+			} else {
+				metricSet.GetOrCreateGauge(id, nil).Set(m.Value)
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if !found {
+		return ErrFileMissing
+	}
+	return nil
+}
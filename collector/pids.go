@@ -8,7 +8,7 @@ import (
 
 func NewPidsCurrentCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "pids.current"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.SingleValueParser{
@@ -19,12 +19,13 @@ func NewPidsCurrentCollector(logger *slog.Logger, cgroups []string) (Collector,
 		fileName:  file,
 		logger:    fileLogger,
 		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		zeroFill:  true,
 	}, nil
 }
 
 func NewPidsPeakCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
 	file := "pids.peak"
-	fileLogger := slog.With(logger, "file", file)
+	fileLogger := logger.With("file", file)
 
 	return &Cgroupv2FileCollector{
 		parser: &parsers.SingleValueParser{
@@ -35,5 +36,44 @@ func NewPidsPeakCollector(logger *slog.Logger, cgroups []string) (Collector, err
 		fileName:  file,
 		logger:    fileLogger,
 		isCounter: func(metricName string, labels map[string]string) bool { return false },
+		zeroFill:  true,
+	}, nil
+}
+
+// NewPidsEventsCollector reports pids.events. Since Linux 6.13 its counts are
+// hierarchical, including the forks denied by the limits of descendants, and
+// pids.events.local holds the cgroup's own.
+func NewPidsEventsCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "pids.events"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.FlatKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames: cgroups,
+		fileName: file,
+		logger:   fileLogger,
+		// "max" counts fork/clone calls denied by pids.max.
+		isCounter: func(metricName string, labels map[string]string) bool { return true },
+	}, nil
+}
+
+// NewPidsEventsLocalCollector reports pids.events.local, the fork/clone calls
+// denied by the cgroup's own pids.max, on Linux 6.13+.
+func NewPidsEventsLocalCollector(logger *slog.Logger, cgroups []string) (Collector, error) {
+	file := "pids.events.local"
+	fileLogger := logger.With("file", file)
+
+	return &Cgroupv2FileCollector{
+		parser: &parsers.FlatKeyValueParser{
+			MetricPrefix: sanitizeP8sName(file),
+			Logger:       fileLogger,
+		},
+		dirNames:  cgroups,
+		fileName:  file,
+		logger:    fileLogger,
+		isCounter: func(metricName string, labels map[string]string) bool { return true },
 	}, nil
 }
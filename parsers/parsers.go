@@ -2,14 +2,31 @@ package parsers
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
 )
 
+// ErrMalformed is returned for a file whose content couldn't be parsed at all,
+// as opposed to an error reading it. Key-value parsers skip single malformed
+// lines; they return ErrMalformed when no line yields a metric.
+var ErrMalformed = errors.New("malformed content")
+
+// malformedError returns nil, or ErrMalformed if there were malformed lines
+// and none of the lines yielded a metric.
+func malformedError(metrics []Metric, malformed int) error {
+	if len(metrics) == 0 && malformed > 0 {
+		return fmt.Errorf("%w: %d malformed lines", ErrMalformed, malformed)
+	}
+	return nil
+}
+
 // Parser defines the interface for file parsers.
 type Parser interface {
 	Parse(io.Reader) ([]Metric, error)
@@ -25,16 +42,44 @@ type Metric struct {
 type SingleValueParser struct {
 	MetricPrefix string
 	Logger       *slog.Logger
+	// ParseUnits accepts values with a K, M or G size suffix (optionally followed
+	// by "i"), interpreted as binary multiples like the kernel does: 512M is 512<<20.
+	ParseUnits bool
 }
 
 type FlatKeyValueParser struct {
 	MetricPrefix string
 	Logger       *slog.Logger
+	// KeyInName puts the key into the metric name (e.g. memory_stat_anon)
+	// instead of a stat label.
+	KeyInName bool
 }
 
 type NestedKeyValueParser struct {
 	MetricPrefix string
 	Logger       *slog.Logger
+	// PrefixInName puts the line prefix into the metric name (e.g. memory_pressure_some_avg10)
+	// instead of a label.
+	PrefixInName bool
+	// SkipKeys lists keys with non-numeric values (e.g. ctrl=auto) which are ignored.
+	SkipKeys []string
+}
+
+// KeyValueOnlyParser parses lines consisting only of key=value pairs, e.g.
+// "rbps=100 wbps=max", into one MetricPrefix_key metric per pair without
+// labels. Unlike NestedKeyValueParser, lines have no leading prefix token to
+// take as a label, so the first pair is a metric like any other. "max" reads
+// as +Inf.
+type KeyValueOnlyParser struct {
+	MetricPrefix string
+	Logger       *slog.Logger
+}
+
+// LineCountParser counts the non-empty lines of a file, e.g. the PIDs listed
+// in cgroup.procs. Lines are streamed, never held all at once.
+type LineCountParser struct {
+	MetricPrefix string
+	Logger       *slog.Logger
 }
 
 type RangeListCountParser struct {
@@ -42,6 +87,94 @@ type RangeListCountParser struct {
 	Logger       *slog.Logger
 }
 
+// StateParser parses a file holding a state name, e.g. cpuset.cpus.partition,
+// into an info metric with value 1 and the state as label. A parenthesized
+// explanation the kernel appends to error states, as in "root invalid (...)",
+// is dropped.
+type StateParser struct {
+	MetricPrefix string
+	Logger       *slog.Logger
+	LabelName    string
+}
+
+// AutoParser parses a file with the SingleValueParser, FlatKeyValueParser,
+// NestedKeyValueParser or KeyValueOnlyParser, chosen by DetectFormat from its first non-empty line.
+// Files of other formats yield no metrics.
+type AutoParser struct {
+	MetricPrefix string
+	Logger       *slog.Logger
+}
+
+// Format is the shape of a cgroup interface file.
+type Format int
+
+const (
+	FormatUnknown        Format = iota
+	FormatSingleValue           // "100" or "max"
+	FormatFlatKeyValue          // "key 100" lines
+	FormatNestedKeyValue        // "prefix key=100 ..." lines
+	FormatKeyValueOnly          // "key=100 ..." lines
+)
+
+// DetectFormat returns the format of a file from its first non-empty line.
+func DetectFormat(line string) Format {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 1 && strings.Contains(fields[0], "="):
+		return FormatKeyValueOnly
+	case len(fields) == 1 && isValue(fields[0]):
+		return FormatSingleValue
+	case len(fields) == 2 && isValue(fields[1]):
+		return FormatFlatKeyValue
+	case len(fields) >= 2 && strings.Contains(fields[1], "="):
+		return FormatNestedKeyValue
+	}
+	return FormatUnknown
+}
+
+func isValue(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil || s == "max"
+}
+
+// isCommentOrBlank reports whether a line of a key-value file carries no
+// values: blank lines and # comments or headers, which are skipped silently.
+func isCommentOrBlank(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// maxLineLength bounds the length of a line in key-value files. Lines are far
+// shorter in practice, longer ones are skipped as corrupted. It is well above
+// bufio.MaxScanTokenSize, so that e.g. a nested key-value line with many keys
+// still parses, while a corrupted file can't make a scan buffer unbounded.
+const maxLineLength = 1024 * 1024
+
+// newBoundedScanner returns a line scanner which skips lines longer than
+// maxLineLength instead of failing with bufio.ErrTooLong.
+func newBoundedScanner(file io.Reader, logger *slog.Logger) *bufio.Scanner {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength)
+	skipping := false
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				skipping = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && err == nil && len(data) >= maxLineLength {
+			logger.Warn("skipping overlong line", "max_length", maxLineLength)
+			skipping = true
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	})
+	return scanner
+}
+
 func readContent(file io.Reader) (string, error) {
 	// Read the entire file content
 	var content strings.Builder
@@ -66,10 +199,14 @@ func (p *SingleValueParser) Parse(file io.Reader) ([]Metric, error) {
 		value = math.Inf(1)
 	} else {
 		var err error
-		value, err = strconv.ParseFloat(content, 64)
+		if p.ParseUnits {
+			value, err = parseSize(content)
+		} else {
+			value, err = strconv.ParseFloat(content, 64)
+		}
 		if err != nil {
 			p.Logger.Error("failed to parse value", "err", err)
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
 		}
 	}
 	return []Metric{
@@ -81,21 +218,53 @@ func (p *SingleValueParser) Parse(file io.Reader) ([]Metric, error) {
 	}, nil
 }
 
+// sizeMultipliers maps the size suffixes understood by parseSize to their value.
+var sizeMultipliers = map[string]float64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+
+// parseSize parses a number with an optional K/M/G or Ki/Mi/Gi suffix into bytes.
+func parseSize(s string) (float64, error) {
+	trimmed := strings.TrimSuffix(s, "i")
+	if n := len(trimmed); n > 1 {
+		if multiplier, ok := sizeMultipliers[strings.ToUpper(trimmed[n-1:])]; ok {
+			value, err := strconv.ParseFloat(trimmed[:n-1], 64)
+			if err != nil {
+				return 0, err
+			}
+			return value * multiplier, nil
+		}
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
 func (p *FlatKeyValueParser) Parse(file io.Reader) ([]Metric, error) {
 	var metrics []Metric
+	malformed := 0
 
 	// Read the file line by line and parse key-value pairs
-	scanner := bufio.NewScanner(file)
+	scanner := newBoundedScanner(file, p.Logger)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if isCommentOrBlank(line) {
+			continue
+		}
 		parts := strings.Fields(line)
 		if len(parts) != 2 {
 			p.Logger.Error("invalid field count", "expected", 2, "got", len(parts))
+			malformed++
 			continue
 		}
 		value, err := strconv.ParseFloat(parts[1], 64)
 		if err != nil {
 			p.Logger.Error("failed to parse value", "err", err)
+			malformed++
+			continue
+		}
+		if p.KeyInName {
+			metrics = append(metrics, Metric{
+				Name:   fmt.Sprintf("%s_%s", p.MetricPrefix, parts[0]),
+				Value:  value,
+				Labels: map[string]string{},
+			})
 			continue
 		}
 		// Use parts[0] as a label instead of embedding in metric name
@@ -111,19 +280,24 @@ func (p *FlatKeyValueParser) Parse(file io.Reader) ([]Metric, error) {
 		return nil, err
 	}
 
-	return metrics, nil
+	return metrics, malformedError(metrics, malformed)
 }
 
 func (p *NestedKeyValueParser) Parse(file io.Reader) ([]Metric, error) {
 	var metrics []Metric
+	malformed := 0
 
 	// Read the file line by line and parse
-	scanner := bufio.NewScanner(file)
+	scanner := newBoundedScanner(file, p.Logger)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if isCommentOrBlank(line) {
+			continue
+		}
 		parts := strings.Fields(line)
 		if len(parts) < 2 {
 			p.Logger.Error("invalid field count", "expected_min", 2, "got", len(parts))
+			malformed++
 			continue
 		}
 		prefix := parts[0]
@@ -131,14 +305,27 @@ func (p *NestedKeyValueParser) Parse(file io.Reader) ([]Metric, error) {
 			metric := strings.Split(m, "=")
 			if len(metric) != 2 {
 				p.Logger.Error("failed to parse key-value pair", "input", m)
+				malformed++
+				continue
+			}
+			if slices.Contains(p.SkipKeys, metric[0]) {
 				continue
 			}
-			metricName := fmt.Sprintf("%s_%s", p.MetricPrefix, metric[0])
 			value, err := strconv.ParseFloat(metric[1], 64)
 			if err != nil {
 				p.Logger.Error("failed to parse value", "err", err)
+				malformed++
+				continue
+			}
+			if p.PrefixInName {
+				metrics = append(metrics, Metric{
+					Name:   fmt.Sprintf("%s_%s_%s", p.MetricPrefix, prefix, metric[0]),
+					Value:  value,
+					Labels: map[string]string{},
+				})
 				continue
 			}
+			metricName := fmt.Sprintf("%s_%s", p.MetricPrefix, metric[0])
 			// Use prefix as a label (e.g., device ID like "259:0" or pressure type like "some", "full")
 			// Detect label name: if metric prefix contains "pressure", use "type", otherwise use "device"
 			labelName := "device"
@@ -158,7 +345,7 @@ func (p *NestedKeyValueParser) Parse(file io.Reader) ([]Metric, error) {
 		return nil, err
 	}
 
-	return metrics, nil
+	return metrics, malformedError(metrics, malformed)
 }
 
 func (p *RangeListCountParser) Parse(file io.Reader) ([]Metric, error) {
@@ -229,3 +416,103 @@ func (p *RangeListCountParser) Parse(file io.Reader) ([]Metric, error) {
 
 	return metrics, nil
 }
+
+func (p *KeyValueOnlyParser) Parse(file io.Reader) ([]Metric, error) {
+	var metrics []Metric
+	malformed := 0
+
+	scanner := newBoundedScanner(file, p.Logger)
+	for scanner.Scan() {
+		if isCommentOrBlank(scanner.Text()) {
+			continue
+		}
+		for _, pair := range strings.Fields(scanner.Text()) {
+			key, valueText, ok := strings.Cut(pair, "=")
+			if !ok || key == "" {
+				p.Logger.Error("failed to parse key-value pair", "input", pair)
+				malformed++
+				continue
+			}
+			value := math.Inf(1)
+			if valueText != "max" {
+				var err error
+				if value, err = strconv.ParseFloat(valueText, 64); err != nil {
+					p.Logger.Error("failed to parse value", "err", err)
+					malformed++
+					continue
+				}
+			}
+			metrics = append(metrics, Metric{
+				Name:   fmt.Sprintf("%s_%s", p.MetricPrefix, key),
+				Value:  value,
+				Labels: map[string]string{},
+			})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		p.Logger.Error("scanner error", "err", err)
+		return nil, err
+	}
+
+	return metrics, malformedError(metrics, malformed)
+}
+
+func (p *LineCountParser) Parse(file io.Reader) ([]Metric, error) {
+	count := 0
+	scanner := newBoundedScanner(file, p.Logger)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		p.Logger.Error("scanner error", "err", err)
+		return nil, err
+	}
+	return []Metric{{Name: p.MetricPrefix, Value: float64(count), Labels: map[string]string{}}}, nil
+}
+
+func (p *AutoParser) Parse(file io.Reader) ([]Metric, error) {
+	content, err := readContent(file)
+	if err != nil {
+		p.Logger.Error("error reading file", "err", err)
+		return nil, err
+	}
+	// readContent trimmed leading blank lines, so the first line is non-empty.
+	firstLine, _, _ := strings.Cut(content, "\n")
+
+	var parser Parser
+	switch DetectFormat(firstLine) {
+	case FormatSingleValue:
+		parser = &SingleValueParser{MetricPrefix: p.MetricPrefix, Logger: p.Logger}
+	case FormatFlatKeyValue:
+		parser = &FlatKeyValueParser{MetricPrefix: p.MetricPrefix, Logger: p.Logger}
+	case FormatNestedKeyValue:
+		parser = &NestedKeyValueParser{MetricPrefix: p.MetricPrefix, Logger: p.Logger}
+	case FormatKeyValueOnly:
+		parser = &KeyValueOnlyParser{MetricPrefix: p.MetricPrefix, Logger: p.Logger}
+	default:
+		p.Logger.Debug("unknown file format, skipping", "line", firstLine)
+		return nil, nil
+	}
+	return parser.Parse(strings.NewReader(content))
+}
+
+func (p *StateParser) Parse(file io.Reader) ([]Metric, error) {
+	content, err := readContent(file)
+	if err != nil {
+		p.Logger.Error("error reading file", "err", err)
+		return nil, err
+	}
+	state, _, _ := strings.Cut(content, "(")
+	state = strings.Join(strings.Fields(state), " ")
+	if state == "" {
+		return nil, nil
+	}
+	return []Metric{{
+		Name:   p.MetricPrefix,
+		Value:  1,
+		Labels: map[string]string{p.LabelName: state},
+	}}, nil
+}
@@ -1,7 +1,10 @@
 package parsers
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
 	"strings"
 	"testing"
@@ -61,6 +64,43 @@ full avg10=5.67 avg60=8.90 avg300=0.12 total=5678`
 	}
 }
 
+func TestNestedKeyValueParserPrefixInName(t *testing.T) {
+	fileContent := `some avg10=1.23 avg60=4.56 avg300=7.89 total=1234
+full avg10=5.67 avg60=8.90 avg300=0.12 total=5678`
+	expected := map[string]float64{
+		"memory_pressure_some_avg10":  1.23,
+		"memory_pressure_some_total":  1234,
+		"memory_pressure_full_avg300": 0.12,
+		"memory_pressure_full_total":  5678,
+	}
+
+	parser := &NestedKeyValueParser{
+		MetricPrefix: "memory_pressure",
+		Logger:       logger,
+		PrefixInName: true,
+	}
+	metrics, err := parser.Parse(strings.NewReader(fileContent))
+	if err != nil {
+		t.Fatalf("Error calling Metrics: %v", err)
+	}
+	if len(metrics) != 8 {
+		t.Fatalf("Expected 8 metrics, got %d", len(metrics))
+	}
+
+	actual := make(map[string]float64)
+	for _, m := range metrics {
+		if len(m.Labels) != 0 {
+			t.Errorf("Expected no labels for %s, got %v", m.Name, m.Labels)
+		}
+		actual[m.Name] = m.Value
+	}
+	for name, value := range expected {
+		if v, ok := actual[name]; !ok || v != value {
+			t.Errorf("Expected %s to be %f, got %f (found: %t)", name, value, v, ok)
+		}
+	}
+}
+
 func TestSingleValueParser(t *testing.T) {
 	fileContent := `5678`
 	file := strings.NewReader(fileContent)
@@ -123,6 +163,44 @@ func TestMaxValue(t *testing.T) {
 	}
 }
 
+func TestSingleValueParserUnits(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"512M", 536870912},
+		{"512Mi", 536870912},
+		{"1G", 1073741824},
+		{"4k", 4096},
+		{"1024", 1024},
+		{"max", math.Inf(1)},
+	}
+	for _, tt := range tests {
+		parser := &SingleValueParser{MetricPrefix: "memory_high", Logger: logger, ParseUnits: true}
+		metrics, err := parser.Parse(strings.NewReader(tt.input))
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", tt.input, err)
+			continue
+		}
+		if metrics[0].Value != tt.expected {
+			t.Errorf("Expected %q to be %f, got %f", tt.input, tt.expected, metrics[0].Value)
+		}
+	}
+
+	for _, input := range []string{"12i", "M"} {
+		parser := &SingleValueParser{MetricPrefix: "memory_high", Logger: logger, ParseUnits: true}
+		if _, err := parser.Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected an error parsing %q", input)
+		}
+	}
+
+	// Suffixes are rejected by default, like the kernel never writes them.
+	parser := &SingleValueParser{MetricPrefix: "memory_high", Logger: logger}
+	if _, err := parser.Parse(strings.NewReader("512M")); err == nil {
+		t.Errorf("Expected an error parsing 512M without ParseUnits")
+	}
+}
+
 func TestKeyValueParser(t *testing.T) {
 	fileContent := `low 0
 	high 5335362
@@ -178,6 +256,138 @@ func TestKeyValueParser(t *testing.T) {
 		}
 	}
 }
+
+func TestCommentAndBlankLinesSkipped(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	for _, tc := range []struct {
+		parser   Parser
+		content  string
+		expected []Metric
+	}{
+		{
+			parser:  &FlatKeyValueParser{MetricPrefix: "test", Logger: logger},
+			content: "# stat value\nlow 1\n\n   \nhigh 2\n",
+			expected: []Metric{
+				{Name: "test", Value: 1, Labels: map[string]string{"stat": "low"}},
+				{Name: "test", Value: 2, Labels: map[string]string{"stat": "high"}},
+			},
+		},
+		{
+			parser:  &NestedKeyValueParser{MetricPrefix: "test", Logger: logger},
+			content: "\n  # device stats\n8:0 rbytes=1\n\n",
+			expected: []Metric{
+				{Name: "test_rbytes", Value: 1, Labels: map[string]string{"device": "8:0"}},
+			},
+		},
+		{
+			parser:  &KeyValueOnlyParser{MetricPrefix: "test", Logger: logger},
+			content: "#a=b\nrbps=1\n\n",
+			expected: []Metric{
+				{Name: "test_rbps", Value: 1, Labels: map[string]string{}},
+			},
+		},
+	} {
+		metrics, err := tc.parser.Parse(strings.NewReader(tc.content))
+		if err != nil {
+			t.Fatalf("Error calling Parse: %v", err)
+		}
+		if fmt.Sprint(metrics) != fmt.Sprint(tc.expected) {
+			t.Errorf("Expected %v, got %v", tc.expected, metrics)
+		}
+	}
+	if logs.Len() > 0 {
+		t.Errorf("Expected no log messages, got:\n%s", logs.String())
+	}
+}
+
+func TestBlankLinesSkippedMalformedLogged(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		parser  func(*slog.Logger) Parser
+		content string
+	}{
+		{
+			name:    "flat",
+			parser:  func(l *slog.Logger) Parser { return &FlatKeyValueParser{MetricPrefix: "test", Logger: l} },
+			content: "low 1\n\nhigh 2\n\t\nmax 3\n\n\n",
+		},
+		{
+			name:    "nested",
+			parser:  func(l *slog.Logger) Parser { return &NestedKeyValueParser{MetricPrefix: "test", Logger: l} },
+			content: "8:0 rbytes=1\n \n8:16 rbytes=2\n259:0 rbytes=3\n\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			metrics, err := tc.parser(slog.New(slog.NewTextHandler(&logs, nil))).Parse(strings.NewReader(tc.content))
+			if err != nil {
+				t.Fatalf("Error calling Parse: %v", err)
+			}
+			if len(metrics) != 3 {
+				t.Errorf("Expected 3 metrics, got %d: %v", len(metrics), metrics)
+			}
+			if logs.Len() > 0 {
+				t.Errorf("Expected no log messages for blank lines, got:\n%s", logs.String())
+			}
+
+			logs.Reset()
+			if _, err := tc.parser(slog.New(slog.NewTextHandler(&logs, nil))).Parse(strings.NewReader("malformed\n")); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Expected ErrMalformed for a file without a valid line, got %v", err)
+			}
+			if !strings.Contains(logs.String(), "level=ERROR") {
+				t.Errorf("Expected an error log for a malformed line, got:\n%s", logs.String())
+			}
+
+			// A single malformed line among valid ones is only logged.
+			metrics, err = tc.parser(logger).Parse(strings.NewReader("malformed\n" + tc.content))
+			if err != nil {
+				t.Errorf("Expected no error with some valid lines, got %v", err)
+			}
+			if len(metrics) != 3 {
+				t.Errorf("Expected 3 metrics, got %d: %v", len(metrics), metrics)
+			}
+		})
+	}
+}
+
+func TestOverlongLineSkipped(t *testing.T) {
+	fileContent := "anon 1\n" + strings.Repeat("x", 2*maxLineLength) + " 2\nfile 3\n"
+
+	flat := &FlatKeyValueParser{MetricPrefix: "memory_stat", Logger: logger}
+	metrics, err := flat.Parse(strings.NewReader(fileContent))
+	if err != nil {
+		t.Fatalf("Error calling Metrics: %v", err)
+	}
+	if len(metrics) != 2 || metrics[0].Labels["stat"] != "anon" || metrics[1].Labels["stat"] != "file" {
+		t.Errorf("Expected the lines around the overlong one, got %v", metrics)
+	}
+
+	fileContent = "8:0 rbytes=1\n" + "8:16 " + strings.Repeat("rbytes=1 ", maxLineLength/4) + "\n259:0 rbytes=3"
+	nested := &NestedKeyValueParser{MetricPrefix: "io_stat", Logger: logger}
+	metrics, err = nested.Parse(strings.NewReader(fileContent))
+	if err != nil {
+		t.Fatalf("Error calling Metrics: %v", err)
+	}
+	if len(metrics) != 2 || metrics[0].Labels["device"] != "8:0" || metrics[1].Labels["device"] != "259:0" {
+		t.Errorf("Expected the lines around the overlong one, got %v", metrics)
+	}
+
+	// Lines beyond the default buffer of bufio.Scanner are still parsed.
+	var long strings.Builder
+	long.WriteString("8:0")
+	for i := range 10000 {
+		fmt.Fprintf(&long, " key%d=%d", i, i)
+	}
+	metrics, err = nested.Parse(strings.NewReader(long.String() + "\n"))
+	if err != nil {
+		t.Fatalf("Error calling Metrics: %v", err)
+	}
+	if len(metrics) != 10000 {
+		t.Errorf("Expected 10000 metrics of a line longer than bufio.MaxScanTokenSize, got %d", len(metrics))
+	}
+}
+
 func TestRangeListCountParser(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -275,3 +485,149 @@ func TestRangeListCountParser(t *testing.T) {
 		})
 	}
 }
+
+func TestKeyValueOnlyParser(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected []Metric
+	}{
+		{
+			name:    "single line",
+			content: "enable=1 rpct=95.00 rlat=max\n",
+			expected: []Metric{
+				{Name: "test_enable", Value: 1, Labels: map[string]string{}},
+				{Name: "test_rpct", Value: 95, Labels: map[string]string{}},
+				{Name: "test_rlat", Value: math.Inf(1), Labels: map[string]string{}},
+			},
+		},
+		{
+			name:    "multi line",
+			content: "a=1 b=2\nc=3\n\nbad d=4 =5 e=x\n",
+			expected: []Metric{
+				{Name: "test_a", Value: 1, Labels: map[string]string{}},
+				{Name: "test_b", Value: 2, Labels: map[string]string{}},
+				{Name: "test_c", Value: 3, Labels: map[string]string{}},
+				{Name: "test_d", Value: 4, Labels: map[string]string{}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parser := &KeyValueOnlyParser{MetricPrefix: "test", Logger: logger}
+			metrics, err := parser.Parse(strings.NewReader(tc.content))
+			if err != nil {
+				t.Fatalf("Error calling Parse: %v", err)
+			}
+			if fmt.Sprint(metrics) != fmt.Sprint(tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, metrics)
+			}
+		})
+	}
+}
+
+func TestLineCountParser(t *testing.T) {
+	parser := &LineCountParser{MetricPrefix: "test", Logger: logger}
+	for content, expected := range map[string]float64{
+		"":                     0,
+		"1\n":                  1,
+		"1\n22\n333\n\n4444\n": 4,
+		"5\n6":                 2,
+	} {
+		metrics, err := parser.Parse(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("Error calling Parse: %v", err)
+		}
+		if len(metrics) != 1 || metrics[0].Value != expected {
+			t.Errorf("Expected %q to count %f lines, got %v", content, expected, metrics)
+		}
+	}
+}
+
+func TestLineCountParserManyLines(t *testing.T) {
+	var b strings.Builder
+	for pid := 1; pid <= 50000; pid++ {
+		fmt.Fprintf(&b, "%d\n", pid)
+	}
+	parser := &LineCountParser{MetricPrefix: "cgroup_procs", Logger: logger}
+	metrics, err := parser.Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("Error calling Parse: %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("Expected 1 metric, got %d", len(metrics))
+	}
+	if metrics[0].Name != "cgroup_procs" || metrics[0].Value != 50000 {
+		t.Errorf("Expected cgroup_procs 50000, got %s %f", metrics[0].Name, metrics[0].Value)
+	}
+}
+
+func TestAutoParser(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		format   Format
+		expected []Metric
+	}{
+		{
+			name:     "single value",
+			content:  "\n4096\n",
+			format:   FormatSingleValue,
+			expected: []Metric{{Name: "test", Value: 4096, Labels: map[string]string{}}},
+		},
+		{
+			name:     "max",
+			content:  "max\n",
+			format:   FormatSingleValue,
+			expected: []Metric{{Name: "test", Value: math.Inf(1), Labels: map[string]string{}}},
+		},
+		{
+			name:    "flat key-value",
+			content: "low 0\nhigh 5\n",
+			format:  FormatFlatKeyValue,
+			expected: []Metric{
+				{Name: "test", Value: 0, Labels: map[string]string{"stat": "low"}},
+				{Name: "test", Value: 5, Labels: map[string]string{"stat": "high"}},
+			},
+		},
+		{
+			name:    "nested key-value",
+			content: "8:0 rbytes=1 wbytes=2\n",
+			format:  FormatNestedKeyValue,
+			expected: []Metric{
+				{Name: "test_rbytes", Value: 1, Labels: map[string]string{"device": "8:0"}},
+				{Name: "test_wbytes", Value: 2, Labels: map[string]string{"device": "8:0"}},
+			},
+		},
+		{
+			name:    "key-value only",
+			content: "rbps=1 wbps=max\n",
+			format:  FormatKeyValueOnly,
+			expected: []Metric{
+				{Name: "test_rbps", Value: 1, Labels: map[string]string{}},
+				{Name: "test_wbps", Value: math.Inf(1), Labels: map[string]string{}},
+			},
+		},
+		{name: "words", content: "domain threaded\n", format: FormatUnknown},
+		{name: "empty", content: "", format: FormatUnknown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			firstLine, _, _ := strings.Cut(strings.TrimSpace(tc.content), "\n")
+			if format := DetectFormat(firstLine); format != tc.format {
+				t.Errorf("Expected format %d, got %d", tc.format, format)
+			}
+			parser := &AutoParser{MetricPrefix: "test", Logger: logger}
+			metrics, err := parser.Parse(strings.NewReader(tc.content))
+			if err != nil {
+				t.Fatalf("Error calling Parse: %v", err)
+			}
+			if len(metrics) != len(tc.expected) {
+				t.Fatalf("Expected %d metrics, got %d: %v", len(tc.expected), len(metrics), metrics)
+			}
+			for i, expected := range tc.expected {
+				if fmt.Sprint(metrics[i]) != fmt.Sprint(expected) {
+					t.Errorf("Expected %v, got %v", expected, metrics[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package remotewrite sends metrics in the Prometheus text format to an
+// endpoint speaking the Prometheus remote write protocol (version 1).
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// Client periodically gathers metrics and writes them to URL.
+type Client struct {
+	// URL is the remote write endpoint, e.g. http://prometheus:9090/api/v1/write.
+	URL string
+	// Interval is the time between two writes.
+	Interval time.Duration
+	// WriteMetrics writes the metrics to send in the Prometheus text format.
+	WriteMetrics func(io.Writer)
+	Logger       *slog.Logger
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// MinBackoff and MaxBackoff bound the exponential backoff between retries of
+	// a failed write. A write is retried until the next one is due.
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// Run writes the metrics every c.Interval until ctx is done.
+func (c *Client) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deadline, cancel := context.WithTimeout(ctx, c.Interval)
+			if err := c.writeWithRetries(deadline, now); err != nil {
+				c.Logger.Error("remote write failed, dropping samples", "url", c.URL, "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// recoverableError marks failures worth retrying: network errors, 429 and 5xx.
+type recoverableError struct{ error }
+
+func (c *Client) writeWithRetries(ctx context.Context, now time.Time) error {
+	var buf bytes.Buffer
+	c.WriteMetrics(&buf)
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		return fmt.Errorf("couldn't parse metrics: %w", err)
+	}
+	body := snappyEncode(Encode(families, now))
+
+	backoff := c.MinBackoff
+	for {
+		err := c.write(ctx, body)
+		var recoverable recoverableError
+		if err == nil || !errors.As(err, &recoverable) {
+			return err
+		}
+		c.Logger.Debug("remote write failed, retrying", "url", c.URL, "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, c.MaxBackoff)
+	}
+}
+
+func (c *Client) write(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return recoverableError{fmt.Errorf("server returned %s", resp.Status)}
+	default:
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+}
+
+// Encode returns the protobuf encoded WriteRequest with one sample at ts per
+// gauge, counter and untyped metric of families.
+func Encode(families map[string]*dto.MetricFamily, ts time.Time) []byte {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var req []byte
+	for _, name := range names {
+		for _, m := range families[name].GetMetric() {
+			var value float64
+			switch {
+			case m.Gauge != nil:
+				value = m.Gauge.GetValue()
+			case m.Counter != nil:
+				value = m.Counter.GetValue()
+			case m.Untyped != nil:
+				value = m.Untyped.GetValue()
+			default:
+				continue
+			}
+			labels := map[string]string{model.MetricNameLabel: name}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			req = appendBytes(req, 1, encodeTimeSeries(labels, value, ts.UnixMilli()))
+		}
+	}
+	return req
+}
+
+// encodeTimeSeries encodes a TimeSeries message, with its labels sorted by name
+// as the protocol requires.
+func encodeTimeSeries(labels map[string]string, value float64, timestampMs int64) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ts []byte
+	for _, name := range names {
+		var label []byte
+		label = appendBytes(label, 1, []byte(name))
+		label = appendBytes(label, 2, []byte(labels[name]))
+		ts = appendBytes(ts, 1, label)
+	}
+	var sample []byte
+	sample = binary.AppendUvarint(sample, 1<<3|1) // field 1, fixed64
+	sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+	sample = binary.AppendUvarint(sample, 2<<3|0) // field 2, varint
+	sample = binary.AppendUvarint(sample, uint64(timestampMs))
+	return appendBytes(ts, 2, sample)
+}
+
+// appendBytes appends a length-delimited protobuf field.
+func appendBytes(b []byte, field uint64, v []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyEncode returns src in the snappy block format, as literals only. This
+// doesn't compress, but any snappy decoder accepts it.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 1<<16)
+		// Tag 61<<2 announces a literal whose length-1 follows in two bytes.
+		dst = append(dst, 61<<2)
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(n-1))
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
@@ -0,0 +1,130 @@
+package remotewrite
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snappyDecode decodes the literal-only blocks written by snappyEncode.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, l := binary.Uvarint(src)
+	src = src[l:]
+	var dst []byte
+	for len(src) > 0 {
+		if src[0] != 61<<2 || len(src) < 3 {
+			return nil, fmt.Errorf("unexpected tag %x", src[0])
+		}
+		size := int(binary.LittleEndian.Uint16(src[1:])) + 1
+		dst = append(dst, src[3:3+size]...)
+		src = src[3+size:]
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("expected %d bytes, got %d", n, len(dst))
+	}
+	return dst, nil
+}
+
+// fields splits a protobuf message into its fields, keyed by field number.
+func fields(t *testing.T, msg []byte) map[uint64][][]byte {
+	t.Helper()
+	fs := make(map[uint64][][]byte)
+	for len(msg) > 0 {
+		key, l := binary.Uvarint(msg)
+		msg = msg[l:]
+		switch key & 7 {
+		case 0:
+			_, l := binary.Uvarint(msg)
+			fs[key>>3] = append(fs[key>>3], msg[:l])
+			msg = msg[l:]
+		case 1:
+			fs[key>>3] = append(fs[key>>3], msg[:8])
+			msg = msg[8:]
+		case 2:
+			size, l := binary.Uvarint(msg)
+			fs[key>>3] = append(fs[key>>3], msg[l:l+int(size)])
+			msg = msg[l+int(size):]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return fs
+}
+
+// samples decodes a WriteRequest into one "labels value" string per series.
+func samples(t *testing.T, req []byte) []string {
+	var out []string
+	for _, ts := range fields(t, req)[1] {
+		tsFields := fields(t, ts)
+		var labels []string
+		for _, label := range tsFields[1] {
+			lf := fields(t, label)
+			labels = append(labels, fmt.Sprintf("%s=%s", lf[1][0], lf[2][0]))
+		}
+		value := math.Float64frombits(binary.LittleEndian.Uint64(fields(t, tsFields[2][0])[1][0]))
+		out = append(out, fmt.Sprintf("%s %g", strings.Join(labels, ","), value))
+	}
+	return out
+}
+
+func TestRun(t *testing.T) {
+	received := make(chan []string, 10)
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// The first write fails and has to be retried.
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Expected a snappy compressed protobuf, got headers %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := snappyDecode(body)
+		if err != nil {
+			t.Errorf("Error decoding body: %v", err)
+			return
+		}
+		select {
+		case received <- samples(t, req):
+		default:
+		}
+	}))
+	defer receiver.Close()
+
+	c := &Client{
+		URL:      receiver.URL,
+		Interval: 20 * time.Millisecond,
+		WriteMetrics: func(w io.Writer) {
+			io.WriteString(w, "cgroupv2_memory_current{cgroup=\"foo\"} 100\ncgroupv2_exporter_open_fds 7\n")
+		},
+		Logger:     slog.New(slog.DiscardHandler),
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	select {
+	case got := <-received:
+		expected := []string{
+			"__name__=cgroupv2_exporter_open_fds 7",
+			"__name__=cgroupv2_memory_current,cgroup=foo 100",
+		}
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected samples %v, got %v", expected, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected samples to arrive, got none")
+	}
+}